@@ -1,10 +1,14 @@
 package senpai
 
 import (
-	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"git.sr.ht/~taiite/senpai/irc"
@@ -14,18 +18,69 @@ import (
 
 type App struct {
 	win     *ui.UI
-	s       *irc.Session
 	pasting bool
 
+	// networks are the connections to the server, by bouncer network ID.
+	// The main connection, to the configured server, has the ID "".
+	networks map[string]*network
+	events   chan event
+
 	cfg        Config
 	highlights []string
 
-	lastQuery string
+	lastQuery    string
+	lastQueryNet string
+	quitReason   string
+
+	// srv is the server of the main connection.
+	srv ServerConfig
+	sts *stsPolicies
+
+	// stsUpgrade is where to reconnect once the main session stops, after
+	// the server has advertised an STS policy on a plaintext connection.
+	stsUpgrade *ServerConfig
+}
+
+// network is a connection to the server, either the main one or one bound to
+// a network of the bouncer (soju.im/bouncer-networks extension).
+type network struct {
+	id string
+	s  *irc.Session
+
+	// attrs are the attributes of the bouncer network, such as its name.
+	attrs map[string]string
+
+	lag time.Duration
+
+	// presence is whether contacts are online, once known.
+	presence map[string]bool
+}
+
+// name returns the name of the bouncer network, or its host if it has none.
+func (n *network) name() string {
+	if name := n.attrs["name"]; name != "" {
+		return name
+	}
+	if host := n.attrs["host"]; host != "" {
+		return host
+	}
+	return n.id
+}
+
+// event is an event of the session s of a network, or nil once s has stopped.
+// While the network connects, s is nil and ev is a connectEvent.
+type event struct {
+	netID string
+	s     *irc.Session
+	ev    irc.Event
 }
 
 func NewApp(cfg Config) (app *App, err error) {
 	app = &App{
-		cfg: cfg,
+		networks:   map[string]*network{"": {}},
+		events:     make(chan event, 128),
+		cfg:        cfg,
+		quitReason: cfg.QuitMessage,
 	}
 
 	if cfg.Highlights != nil {
@@ -49,87 +104,294 @@ func NewApp(cfg Config) (app *App, err error) {
 
 	app.initWindow()
 
-	var conn *tls.Conn
-	app.addLineNow(Home, ui.Line{
-		Head: "--",
-		Body: fmt.Sprintf("Connecting to %s...", cfg.Addr),
-	})
-	conn, err = tls.Dial("tcp", cfg.Addr, nil)
+	path, err := stsPath()
+	if err == nil {
+		app.sts, err = loadSTSPolicies(path)
+	}
 	if err != nil {
-		app.addLineNow(Home, ui.Line{
+		app.addLineNow("", Home, ui.Line{
 			Head:      "!!",
 			HeadColor: ui.ColorRed,
-			Body:      "Connection failed",
+			Body:      fmt.Sprintf("Failed to load STS policies: %v", err),
+		})
+		app.sts = &stsPolicies{path: path, policies: map[string]stsPolicy{}}
+	}
+
+	app.connect("", cfg.Servers)
+	err = nil
+	return
+}
+
+// session returns the session of the given network, or nil if there is none.
+func (app *App) session(netID string) *irc.Session {
+	if n, ok := app.networks[netID]; ok {
+		return n.s
+	}
+	return nil
+}
+
+// connect connects to the first of servers that accepts the connection, and
+// starts a session with it for the given network.  Plaintext connections to
+// hosts that have an STS policy are upgraded to TLS.  Servers are dialed in
+// the background, and the session is handed to the main loop once started.
+func (app *App) connect(netID string, servers []ServerConfig) {
+	auths, err := saslClients(app.cfg)
+	if err != nil {
+		app.addLineNow(netID, Home, ui.Line{
+			Head:      "!!",
+			HeadColor: ui.ColorRed,
+			Body:      err.Error(),
 		})
-		err = nil
 		return
 	}
+	var nickServPassword string
+	if app.cfg.Password != nil && app.cfg.NickServ {
+		nickServPassword = *app.cfg.Password
+	}
+	params := irc.SessionParams{
+		Nickname:         app.cfg.Nick,
+		Username:         app.cfg.User,
+		RealName:         app.cfg.Real,
+		Auths:            auths,
+		Password:         app.cfg.ServerPassword,
+		NickServPassword: nickServPassword,
+		SendBurst:        app.cfg.SendBurst,
+		SendRate:         app.cfg.SendRate,
+		PingInterval:     app.cfg.PingInterval,
+		PingTimeout:      app.cfg.PingTimeout,
+		NetID:            netID,
+		Debug:            app.cfg.Debug,
+	}
 
-	var auth irc.SASLClient
-	if cfg.Password != nil {
-		auth = &irc.SASLPlain{Username: cfg.User, Password: *cfg.Password}
+	// The policies are only used from the main loop.
+	upgraded := make([]ServerConfig, len(servers))
+	for i, srv := range servers {
+		if u, ok := app.sts.Upgrade(srv); ok {
+			app.addLineNow(netID, Home, ui.Line{
+				Head: "--",
+				Body: fmt.Sprintf("%s requires TLS (STS policy), using %s instead", srv.Addr, u.Addr),
+			})
+			srv = u
+		}
+		upgraded[i] = srv
 	}
-	app.s, err = irc.NewSession(conn, irc.SessionParams{
-		Nickname: cfg.Nick,
-		Username: cfg.User,
-		RealName: cfg.Real,
-		Auth:     auth,
-		Debug:    cfg.Debug,
-	})
+	go app.dial(netID, upgraded, params)
+}
+
+// connectEvent is sent by dial to the main loop: line is shown in the home
+// buffer of the network, and s is the session that has been started with
+// srv, if any.
+type connectEvent struct {
+	line ui.Line
+	srv  ServerConfig
+	s    *irc.Session
+}
+
+// dial is the part of connect that blocks.  It tells the main loop how it
+// goes through app.events.
+func (app *App) dial(netID string, servers []ServerConfig, params irc.SessionParams) {
+	report := func(line ui.Line) {
+		line.At = time.Now()
+		app.events <- event{netID: netID, ev: connectEvent{line: line}}
+	}
+
+	var conn io.ReadWriteCloser
+	var srv ServerConfig
+	var err error
+	for _, srv = range servers {
+		report(ui.Line{
+			Head: "--",
+			Body: fmt.Sprintf("Connecting to %s...", srv.Addr),
+		})
+		conn, err = dial(app.cfg.Proxy, srv)
+		if err == nil {
+			break
+		}
+		report(ui.Line{
+			Head:      "!!",
+			HeadColor: ui.ColorRed,
+			Body:      fmt.Sprintf("Connection failed: %v", err),
+		})
+	}
+	if conn == nil {
+		return
+	}
+
+	params.Secure = stsHost(srv) == "" || srv.TLS == nil || *srv.TLS
+	s, err := irc.NewSession(conn, params)
 	if err != nil {
-		app.addLineNow(Home, ui.Line{
+		report(ui.Line{
 			Head:      "!!",
 			HeadColor: ui.ColorRed,
 			Body:      "Registration failed",
 		})
+		conn.Close()
+		return
+	}
+	app.events <- event{netID: netID, ev: connectEvent{srv: srv, s: s}}
+}
+
+// handleConnect shows how the connection of the network goes, and starts
+// polling its session once it has been handed over.
+func (app *App) handleConnect(netID string, c connectEvent) {
+	n, ok := app.networks[netID]
+	if !ok {
+		// The network has been deleted while connecting.
+		if c.s != nil {
+			c.s.Discard()
+		}
+		return
+	}
+	if c.s == nil {
+		app.win.AddLine(netID, Home, false, c.line)
+		return
+	}
+
+	contacts := app.cfg.Contacts
+	if n.s != nil {
+		// Keep the contacts added since the start.
+		for _, contact := range n.s.Contacts() {
+			contacts = append(contacts, contact.Name)
+		}
+	}
+	if len(contacts) != 0 {
+		c.s.Monitor(contacts...)
+	}
+
+	n.id = netID
+	n.s = c.s
+	n.lag = 0
+	n.presence = map[string]bool{}
+	if netID == "" {
+		app.srv = c.srv
+	}
+	go app.poll(netID, c.s)
+}
+
+// poll forwards the events of the session of a network to the main loop, then
+// tells it that the session has stopped.
+func (app *App) poll(netID string, s *irc.Session) {
+	for ev := range s.Poll() {
+		app.events <- event{netID: netID, s: s, ev: ev}
+	}
+	app.events <- event{netID: netID, s: s}
+}
+
+// saslClients returns the SASL clients to log in with, in the order of
+// preference of the configuration.  By default, only PLAIN is used, if a
+// password is set.
+func saslClients(cfg Config) (auths []irc.SASLClient, err error) {
+	mechs := cfg.SASLMechanisms
+	if mechs == nil {
+		mechs = []string{"PLAIN"}
 	}
 
+	for _, mech := range mechs {
+		switch strings.ToUpper(mech) {
+		case "PLAIN":
+			if cfg.Password != nil {
+				auths = append(auths, &irc.SASLPlain{Username: cfg.User, Password: *cfg.Password})
+			}
+		case "EXTERNAL":
+			auths = append(auths, &irc.SASLExternal{})
+		default:
+			err = fmt.Errorf("unsupported SASL mechanism %q", mech)
+			return
+		}
+	}
 	return
 }
 
 func (app *App) Close() {
 	app.win.Close()
-	if app.s != nil {
-		app.s.Stop()
+
+	var wg sync.WaitGroup
+	for _, n := range app.networks {
+		if n.s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *irc.Session) {
+			defer wg.Done()
+			s.Quit(app.quitReason)
+			// The main loop is not running anymore.
+			s.Discard()
+		}(n.s)
 	}
+	wg.Wait()
 }
 
 func (app *App) Run() {
 	for !app.win.ShouldExit() {
-		if app.s != nil {
-			select {
-			case ev := <-app.s.Poll():
-				evs := []irc.Event{ev}
-			Batch:
-				for i := 0; i < 64; i++ {
-					select {
-					case ev := <-app.s.Poll():
-						evs = append(evs, ev)
-					default:
-						break Batch
-					}
+		var redraw <-chan time.Time
+		netID, _ := app.win.CurrentBuffer()
+		if s := app.session(netID); s != nil && s.Running() && 0 < s.Queued() {
+			// Keep the send queue indicator up to date.
+			redraw = time.After(500 * time.Millisecond)
+		}
+
+		select {
+		case ev := <-app.events:
+			evs := []event{ev}
+		Batch:
+			for i := 0; i < 64; i++ {
+				select {
+				case ev := <-app.events:
+					evs = append(evs, ev)
+				default:
+					break Batch
 				}
-				app.handleIRCEvents(evs)
-			case ev := <-app.win.Events:
-				app.handleUIEvent(ev)
 			}
-		} else {
-			ev := <-app.win.Events
+			app.handleIRCEvents(evs)
+		case ev := <-app.win.Events:
 			app.handleUIEvent(ev)
+		case <-redraw:
+			if !app.pasting {
+				app.draw()
+			}
 		}
 	}
 }
 
-func (app *App) handleIRCEvents(evs []irc.Event) {
+func (app *App) handleIRCEvents(evs []event) {
 	for _, ev := range evs {
-		app.handleIRCEvent(ev)
+		if c, ok := ev.ev.(connectEvent); ok {
+			app.handleConnect(ev.netID, c)
+			continue
+		}
+		n, ok := app.networks[ev.netID]
+		if !ok || n.s != ev.s {
+			// The network has been deleted, or has reconnected since.
+			continue
+		}
+		if ev.ev == nil {
+			app.handleStop(n)
+		} else {
+			app.handleIRCEvent(n, ev.ev)
+		}
 	}
 	if !app.pasting {
 		app.draw()
 	}
 }
 
-func (app *App) handleIRCEvent(ev irc.Event) {
+// handleStop is called once the session of a network has stopped.
+func (app *App) handleStop(n *network) {
+	if n.id == "" && app.stsUpgrade != nil {
+		srv := *app.stsUpgrade
+		app.stsUpgrade = nil
+		app.connect(n.id, []ServerConfig{srv})
+		return
+	}
+	app.addLineNow(n.id, Home, ui.Line{
+		Head:      "!!",
+		HeadColor: ui.ColorRed,
+		Body:      "Disconnected from the server",
+	})
+}
+
+func (app *App) handleIRCEvent(n *network, ev irc.Event) {
+	s := n.s
 	switch ev := ev.(type) {
 	case irc.RawMessageEvent:
 		head := "IN --"
@@ -138,51 +400,108 @@ func (app *App) handleIRCEvent(ev irc.Event) {
 		} else if !ev.IsValid {
 			head = "IN ??"
 		}
-		app.win.AddLine(Home, false, ui.Line{
+		app.win.AddLine(n.id, Home, false, ui.Line{
 			At:   time.Now(),
 			Head: head,
 			Body: ev.Message,
 		})
 	case irc.RegisteredEvent:
 		body := "Connected to the server"
-		if app.s.Nick() != app.cfg.Nick {
-			body += " as " + app.s.Nick()
+		if s.Nick() != app.cfg.Nick {
+			body += " as " + s.Nick()
 		}
-		app.win.AddLine(Home, false, ui.Line{
+		app.win.AddLine(n.id, Home, false, ui.Line{
 			At:   time.Now(),
 			Head: "--",
 			Body: body,
 		})
+	case irc.LagEvent:
+		n.lag = ev.Lag
+	case irc.STSUpgradeEvent:
+		host := stsHost(app.srv)
+		if n.id != "" || host == "" {
+			break
+		}
+		// STS requires a valid certificate, so TLSSkipVerify is not
+		// carried over.
+		secure := true
+		app.stsUpgrade = &ServerConfig{
+			Addr: net.JoinHostPort(host, strconv.Itoa(ev.Port)),
+			TLS:  &secure,
+		}
+		app.addLineNow(n.id, Home, ui.Line{
+			At:   time.Now(),
+			Head: "--",
+			Body: "The server requires TLS (STS policy), reconnecting...",
+		})
+	case irc.STSPolicyEvent:
+		host, port, err := net.SplitHostPort(app.srv.Addr)
+		if n.id != "" || err != nil || stsHost(app.srv) == "" {
+			break
+		}
+		if app.srv.TLSSkipVerify {
+			// Policies only hold over verified connections.
+			break
+		}
+		p, _ := strconv.Atoi(port)
+		err = app.sts.Set(host, p, ev.Duration)
+		if err != nil {
+			app.addLineNow(n.id, Home, ui.Line{
+				At:        time.Now(),
+				Head:      "!!",
+				HeadColor: ui.ColorRed,
+				Body:      fmt.Sprintf("Failed to save the STS policy: %v", err),
+			})
+		}
+	case irc.BouncerNetworkEvent:
+		if n.id != "" {
+			// Bound sessions are told about the networks as well.
+			break
+		}
+		app.updateNetwork(ev)
 	case irc.SelfNickEvent:
-		app.win.AddLine(app.win.CurrentBuffer(), true, ui.Line{
+		curNetID, buffer := app.win.CurrentBuffer()
+		if curNetID != n.id {
+			buffer = Home
+		}
+		app.win.AddLine(n.id, buffer, true, ui.Line{
 			At:        ev.Time,
 			Head:      "--",
-			Body:      fmt.Sprintf("\x0314%s\x03\u2192\x0314%s\x03", ev.FormerNick, app.s.Nick()),
+			Body:      fmt.Sprintf("\x0314%s\x03\u2192\x0314%s\x03", ev.FormerNick, s.Nick()),
 			Highlight: true,
 		})
 	case irc.UserNickEvent:
-		for _, c := range app.s.ChannelsSharedWith(ev.User.Name) {
-			app.win.AddLine(c, false, ui.Line{
+		for _, c := range s.ChannelsSharedWith(ev.User.Name) {
+			app.win.AddLine(n.id, c, false, ui.Line{
 				At:        ev.Time,
 				Head:      "--",
 				Body:      fmt.Sprintf("\x0314%s\x03\u2192\x0314%s\x03", ev.FormerNick, ev.User.Name),
 				Mergeable: true,
 			})
 		}
+	case irc.SetNameEvent:
+		if s.NickCf() != s.Casemap(ev.User.Name) {
+			break
+		}
+		app.win.AddLine(n.id, Home, false, ui.Line{
+			At:   ev.Time,
+			Head: "--",
+			Body: fmt.Sprintf("\x0314Your real name is now: %s\x03", ev.RealName),
+		})
 	case irc.SelfJoinEvent:
-		app.win.AddBuffer(ev.Channel)
-		app.s.RequestHistory(ev.Channel, time.Now())
+		app.win.AddBuffer(n.id, n.name(), ev.Channel)
+		s.RequestHistory(ev.Channel, time.Now())
 	case irc.UserJoinEvent:
-		app.win.AddLine(ev.Channel, false, ui.Line{
+		app.win.AddLine(n.id, ev.Channel, false, ui.Line{
 			At:        time.Now(),
 			Head:      "--",
 			Body:      fmt.Sprintf("\x033+\x0314%s\x03", ev.User.Name),
 			Mergeable: true,
 		})
 	case irc.SelfPartEvent:
-		app.win.RemoveBuffer(ev.Channel)
+		app.win.RemoveBuffer(n.id, ev.Channel)
 	case irc.UserPartEvent:
-		app.win.AddLine(ev.Channel, false, ui.Line{
+		app.win.AddLine(n.id, ev.Channel, false, ui.Line{
 			At:        ev.Time,
 			Head:      "--",
 			Body:      fmt.Sprintf("\x034-\x0314%s\x03", ev.User.Name),
@@ -190,42 +509,168 @@ func (app *App) handleIRCEvent(ev irc.Event) {
 		})
 	case irc.UserQuitEvent:
 		for _, c := range ev.Channels {
-			app.win.AddLine(c, false, ui.Line{
+			app.win.AddLine(n.id, c, false, ui.Line{
 				At:        ev.Time,
 				Head:      "--",
 				Body:      fmt.Sprintf("\x034-\x0314%s\x03", ev.User.Name),
 				Mergeable: true,
 			})
 		}
+	case irc.ChannelRenameEvent:
+		app.win.RenameBuffer(n.id, ev.FormerName, ev.Name)
+		body := fmt.Sprintf("\x0314Channel renamed from %s to %s\x03", ev.FormerName, ev.Name)
+		if ev.Reason != "" {
+			body = fmt.Sprintf("\x0314Channel renamed from %s to %s: %s\x03", ev.FormerName, ev.Name, ev.Reason)
+		}
+		app.win.AddLine(n.id, ev.Name, false, ui.Line{
+			At:   ev.Time,
+			Head: "--",
+			Body: body,
+		})
 	case irc.TopicChangeEvent:
-		app.win.AddLine(ev.Channel, false, ui.Line{
+		app.win.AddLine(n.id, ev.Channel, false, ui.Line{
 			At:   ev.Time,
 			Head: "--",
 			Body: fmt.Sprintf("\x0314Topic changed to: %s\x03", ev.Topic),
 		})
+	case irc.PresenceEvent:
+		nickCf := s.Casemap(ev.User.Name)
+		if online, ok := n.presence[nickCf]; ok && online != ev.Online {
+			body := fmt.Sprintf("\x0314%s is now offline\x03", ev.User.Name)
+			if ev.Online {
+				body = fmt.Sprintf("\x033%s\x0314 is now online\x03", ev.User.Name)
+			}
+			app.win.AddLine(n.id, Home, false, ui.Line{
+				At:   time.Now(),
+				Head: "--",
+				Body: body,
+			})
+		}
+		n.presence[nickCf] = ev.Online
+		app.updateContacts(n.id)
 	case irc.MessageEvent:
-		buffer, line, hlNotification := app.formatMessage(ev)
-		app.win.AddLine(buffer, hlNotification, line)
+		buffer, line, hlNotification := app.formatMessage(n.id, ev)
+		app.win.AddLine(n.id, buffer, hlNotification, line)
 		if hlNotification {
-			app.notifyHighlight(buffer, ev.User.Name, ev.Content)
+			app.notifyHighlight(n.id, buffer, ev.User.Name, ev.Content)
 		}
-		if !ev.TargetIsChannel && app.s.NickCf() != app.s.Casemap(ev.User.Name) {
+		if !ev.TargetIsChannel && s.NickCf() != s.Casemap(ev.User.Name) {
 			app.lastQuery = ev.User.Name
+			app.lastQueryNet = n.id
 		}
+	case irc.ReadMarkerEvent:
+		app.win.SetRead(n.id, ev.Target, ev.Time)
+	case irc.ReactionEvent:
+		app.win.AddReaction(n.id, app.reactionBuffer(ev), ev.MsgID, ev.User.Name, ev.Reaction)
+	case irc.RedactEvent:
+		buffer := Home
+		if ev.TargetIsChannel {
+			buffer = ev.Target
+		}
+		app.win.Redact(n.id, buffer, ev.MsgID, redactedBody(ev))
 	case irc.HistoryEvent:
 		var lines []ui.Line
+		var reactions []irc.ReactionEvent
+		var redactions []irc.RedactEvent
 		for _, m := range ev.Messages {
 			switch m := m.(type) {
 			case irc.MessageEvent:
-				_, line, _ := app.formatMessage(m)
+				_, line, _ := app.formatMessage(n.id, m)
 				lines = append(lines, line)
+			case irc.ReactionEvent:
+				reactions = append(reactions, m)
+			case irc.RedactEvent:
+				redactions = append(redactions, m)
 			default:
 			}
 		}
-		app.win.AddLines(ev.Target, lines)
+		app.win.AddLines(n.id, ev.Target, lines)
+		for _, r := range reactions {
+			app.win.AddReaction(n.id, ev.Target, r.MsgID, r.User.Name, r.Reaction)
+		}
+		for _, r := range redactions {
+			app.win.Redact(n.id, ev.Target, r.MsgID, redactedBody(r))
+		}
 	case error:
-		panic(ev)
+		app.win.AddLine(n.id, Home, false, ui.Line{
+			At:        time.Now(),
+			Head:      "!!",
+			HeadColor: ui.ColorRed,
+			Body:      ev.Error(),
+		})
+	}
+}
+
+// updateNetwork keeps up with the networks of the bouncer: it connects to the
+// new ones, and removes the buffers of the deleted ones.
+func (app *App) updateNetwork(ev irc.BouncerNetworkEvent) {
+	n, ok := app.networks[ev.ID]
+	if ev.Deleted {
+		if !ok {
+			return
+		}
+		if n.s != nil {
+			// Its events are not handled anymore.
+			n.s.Discard()
+		}
+		delete(app.networks, ev.ID)
+		app.win.RemoveNetworkBuffers(ev.ID)
+		return
 	}
+
+	if !ok {
+		n = &network{id: ev.ID, attrs: map[string]string{}}
+		app.networks[ev.ID] = n
+	}
+	formerState := n.attrs["state"]
+	for k, v := range ev.Attrs {
+		if v == "" {
+			delete(n.attrs, k)
+		} else {
+			n.attrs[k] = v
+		}
+	}
+
+	if !ok {
+		app.win.AddBuffer(n.id, n.name(), Home)
+		app.connect(n.id, []ServerConfig{app.srv})
+		return
+	}
+	app.win.SetNetworkName(n.id, n.name())
+	if state := n.attrs["state"]; state != formerState {
+		body := fmt.Sprintf("\x0314The bouncer is %s\x03", state)
+		if e := n.attrs["error"]; e != "" {
+			body = fmt.Sprintf("\x0314The bouncer is %s: %s\x03", state, e)
+		}
+		app.win.AddLine(n.id, Home, false, ui.Line{
+			At:   time.Now(),
+			Head: "--",
+			Body: body,
+		})
+	}
+}
+
+// networkID returns the ID of the bouncer network whose name or ID is name.
+func (app *App) networkID(name string) (id string, ok bool) {
+	for id, n := range app.networks {
+		if id != "" && (id == name || strings.EqualFold(n.name(), name)) {
+			return id, true
+		}
+	}
+	return
+}
+
+// networkIDs returns the IDs of the bouncer networks, sorted by name.
+func (app *App) networkIDs() (ids []string) {
+	for id := range app.networks {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return app.networks[ids[i]].name() < app.networks[ids[j]].name()
+	})
+	return
 }
 
 func (app *App) handleMouseEvent(ev *tcell.EventMouse) {
@@ -288,6 +733,9 @@ func (app *App) handleKeyEvent(ev *tcell.EventKey) {
 	case tcell.KeyUp:
 		if ev.Modifiers() == tcell.ModAlt {
 			app.win.PreviousBuffer()
+		} else if ev.Modifiers() == tcell.ModCtrl {
+			app.win.SelectPreviousLine()
+			app.requestHistory()
 		} else {
 			app.win.InputUp()
 		}
@@ -295,10 +743,14 @@ func (app *App) handleKeyEvent(ev *tcell.EventKey) {
 	case tcell.KeyDown:
 		if ev.Modifiers() == tcell.ModAlt {
 			app.win.NextBuffer()
+		} else if ev.Modifiers() == tcell.ModCtrl {
+			app.win.SelectNextLine()
 		} else {
 			app.win.InputDown()
 		}
 		app.updatePrompt()
+	case tcell.KeyEscape:
+		app.win.ClearSelection()
 	case tcell.KeyHome:
 		if ev.Modifiers() == tcell.ModAlt {
 			app.win.GoToBufferNo(0)
@@ -330,11 +782,15 @@ func (app *App) handleKeyEvent(ev *tcell.EventKey) {
 			app.typing()
 		}
 	case tcell.KeyCR, tcell.KeyLF:
-		buffer := app.win.CurrentBuffer()
+		if app.pasting || ev.Modifiers() == tcell.ModAlt {
+			app.win.InputRune('\n')
+			break
+		}
+		netID, buffer := app.win.CurrentBuffer()
 		input := app.win.InputEnter()
-		err := app.handleInput(buffer, input)
+		err := app.handleInput(netID, buffer, input)
 		if err != nil {
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At:        time.Now(),
 				Head:      "!!",
 				HeadColor: ui.ColorRed,
@@ -370,23 +826,24 @@ func (app *App) handleUIEvent(ev tcell.Event) {
 }
 
 func (app *App) requestHistory() {
-	if app.s == nil {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.session(netID)
+	if s == nil {
 		return
 	}
-	buffer := app.win.CurrentBuffer()
 	if app.win.IsAtTop() && buffer != Home {
 		at := time.Now()
 		if t := app.win.CurrentBufferOldestTime(); t != nil {
 			at = *t
 		}
-		app.s.RequestHistory(buffer, at)
+		s.RequestHistory(buffer, at)
 	}
 }
 
-func (app *App) isHighlight(content string) bool {
+func (app *App) isHighlight(s *irc.Session, content string) bool {
 	contentCf := strings.ToLower(content)
 	if app.highlights == nil {
-		return strings.Contains(contentCf, app.s.NickCf())
+		return strings.Contains(contentCf, s.NickCf())
 	}
 	for _, h := range app.highlights {
 		if strings.Contains(contentCf, h) {
@@ -396,13 +853,13 @@ func (app *App) isHighlight(content string) bool {
 	return false
 }
 
-func (app *App) notifyHighlight(buffer, nick, content string) {
+func (app *App) notifyHighlight(netID, buffer, nick, content string) {
 	sh, err := exec.LookPath("sh")
 	if err != nil {
 		return
 	}
 	here := "0"
-	if buffer == app.win.CurrentBuffer() {
+	if curNetID, curBuffer := app.win.CurrentBuffer(); curNetID == netID && curBuffer == buffer {
 		here = "1"
 	}
 	r := strings.NewReplacer(
@@ -414,7 +871,7 @@ func (app *App) notifyHighlight(buffer, nick, content string) {
 	command := r.Replace(app.cfg.OnHighlight)
 	err = exec.Command(sh, "-c", command).Run()
 	if err != nil {
-		app.win.AddLine(Home, false, ui.Line{
+		app.win.AddLine(netID, Home, false, ui.Line{
 			At:        time.Now(),
 			Head:      "ERROR --",
 			HeadColor: ui.ColorRed,
@@ -424,24 +881,24 @@ func (app *App) notifyHighlight(buffer, nick, content string) {
 }
 
 func (app *App) typing() {
-	if app.s == nil {
-		return
-	}
-	buffer := app.win.CurrentBuffer()
-	if buffer == Home {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.session(netID)
+	if s == nil || buffer == Home {
 		return
 	}
 	if app.win.InputLen() == 0 {
-		app.s.TypingStop(buffer)
+		s.TypingStop(buffer)
 	} else if !app.win.InputIsCommand() {
-		app.s.Typing(app.win.CurrentBuffer())
+		s.Typing(buffer)
 	}
 }
 
 func (app *App) completions(cursorIdx int, text []rune) []ui.Completion {
 	var cs []ui.Completion
 
-	if len(text) == 0 {
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.session(netID)
+	if len(text) == 0 || s == nil {
 		return cs
 	}
 
@@ -453,9 +910,9 @@ func (app *App) completions(cursorIdx int, text []rune) []ui.Completion {
 	}
 	start++
 	word := text[start:cursorIdx]
-	wordCf := app.s.Casemap(string(word))
-	for _, name := range app.s.Names(app.win.CurrentBuffer()) {
-		if strings.HasPrefix(app.s.Casemap(name.Name.Name), wordCf) {
+	wordCf := s.Casemap(string(word))
+	for _, name := range s.Names(buffer) {
+		if strings.HasPrefix(s.Casemap(name.Name.Name), wordCf) {
 			nickComp := []rune(name.Name.Name)
 			if start == 0 {
 				nickComp = append(nickComp, ':')
@@ -484,15 +941,16 @@ func (app *App) completions(cursorIdx int, text []rune) []ui.Completion {
 	return cs
 }
 
-func (app *App) formatMessage(ev irc.MessageEvent) (buffer string, line ui.Line, hlNotification bool) {
-	isFromSelf := app.s.NickCf() == app.s.Casemap(ev.User.Name)
-	isHighlight := app.isHighlight(ev.Content)
+func (app *App) formatMessage(netID string, ev irc.MessageEvent) (buffer string, line ui.Line, hlNotification bool) {
+	s := app.session(netID)
+	isFromSelf := s.NickCf() == s.Casemap(ev.User.Name)
+	isHighlight := app.isHighlight(s, ev.Content)
 	isAction := strings.HasPrefix(ev.Content, "\x01ACTION")
 	isQuery := !ev.TargetIsChannel && ev.Command == "PRIVMSG"
 	isNotice := ev.Command == "NOTICE"
 
-	if !ev.TargetIsChannel && isNotice {
-		buffer = app.win.CurrentBuffer()
+	if curNetID, curBuffer := app.win.CurrentBuffer(); !ev.TargetIsChannel && isNotice && curNetID == netID {
+		buffer = curBuffer
 	} else if !ev.TargetIsChannel {
 		buffer = Home
 	} else {
@@ -513,6 +971,11 @@ func (app *App) formatMessage(ev irc.MessageEvent) (buffer string, line ui.Line,
 		headColor = ui.IdentColor(head)
 	}
 
+	target := ev.Target
+	if !ev.TargetIsChannel && !isFromSelf {
+		target = ev.User.Name
+	}
+
 	body := strings.TrimSuffix(ev.Content, "\x01")
 	if isNotice && isAction {
 		c := ircColorSequence(ui.IdentColor(ev.User.Name))
@@ -531,17 +994,58 @@ func (app *App) formatMessage(ev irc.MessageEvent) (buffer string, line ui.Line,
 		Body:      body,
 		HeadColor: headColor,
 		Highlight: hlLine,
+		ID:        ev.ID,
+		ReplyTo:   ev.ReplyTo,
+		Own:       isFromSelf,
+		Target:    target,
 	}
 	return
 }
 
+// redactedBody returns what is shown in place of a deleted message.
+func redactedBody(ev irc.RedactEvent) string {
+	if ev.Reason == "" {
+		return "\x0314(message deleted)\x03"
+	}
+	return fmt.Sprintf("\x0314(message deleted: %s)\x03", ev.Reason)
+}
+
+// updateContacts shows the presence of the contacts of the session of a
+// network in the buffer list, except for those that are being removed.
+func (app *App) updateContacts(netID string, removed ...string) {
+	s := app.session(netID)
+	var contacts []ui.Contact
+contacts:
+	for _, c := range s.Contacts() {
+		for _, nick := range removed {
+			if s.Casemap(nick) == s.Casemap(c.Name) {
+				continue contacts
+			}
+		}
+		contacts = append(contacts, ui.Contact{
+			Name:   c.Name,
+			Online: c.Online,
+		})
+	}
+	app.win.SetContacts(netID, contacts)
+}
+
+// reactionBuffer returns the buffer of the message a reaction is about.
+func (app *App) reactionBuffer(ev irc.ReactionEvent) string {
+	if ev.TargetIsChannel {
+		return ev.Target
+	}
+	return Home
+}
+
 func (app *App) updatePrompt() {
-	buffer := app.win.CurrentBuffer()
+	netID, buffer := app.win.CurrentBuffer()
+	s := app.session(netID)
 	command := app.win.InputIsCommand()
-	if buffer == Home || command {
+	if buffer == Home || command || s == nil {
 		app.win.SetPrompt(">")
 	} else {
-		app.win.SetPrompt(app.s.Nick())
+		app.win.SetPrompt(s.Nick())
 	}
 }
 
@@ -30,11 +30,12 @@ func main() {
 		log.Panicf("Failed to register to %s: %v", addr, err)
 	}
 
-	for {
-		ev := <-cli.Poll()
-		switch ev := ev.(type) {
-		case error:
-			log.Panicln(ev)
-		}
-	}
+	cli.Dispatch(&irc.Handlers{
+		Registered: func(s *irc.Session, ev irc.RegisteredEvent) {
+			log.Printf("Registered as %s.\n", s.Nick())
+		},
+		Error: func(s *irc.Session, err error) {
+			log.Panicln(err)
+		},
+	})
 }
@@ -10,11 +10,12 @@ import (
 )
 
 type command struct {
-	MinArgs   int
-	AllowHome bool
-	Usage     string
-	Desc      string
-	Handle    func(app *App, buffer string, args []string) error
+	MinArgs      int
+	AllowHome    bool
+	AllowOffline bool
+	Usage        string
+	Desc         string
+	Handle       func(app *App, netID, buffer string, args []string) error
 }
 
 type commandSet map[string]*command
@@ -28,10 +29,11 @@ func init() {
 			Handle:  commandDo,
 		},
 		"HELP": {
-			AllowHome: true,
-			Usage:     "[command]",
-			Desc:      "show the list of commands, or how to use the given one",
-			Handle:    commandDoHelp,
+			AllowHome:    true,
+			AllowOffline: true,
+			Usage:        "[command]",
+			Desc:         "show the list of commands, or how to use the given one",
+			Handle:       commandDoHelp,
 		},
 		"JOIN": {
 			MinArgs:   1,
@@ -47,6 +49,12 @@ func init() {
 			Desc:      "send an action (reply to last query if sent from home)",
 			Handle:    commandDoMe,
 		},
+		"MONITOR": {
+			AllowHome: true,
+			Usage:     "[add|remove <nicks>]",
+			Desc:      "show the contacts, whose presence is monitored, or add or remove some",
+			Handle:    commandDoMonitor,
+		},
 		"MSG": {
 			AllowHome: true,
 			MinArgs:   2,
@@ -58,12 +66,26 @@ func init() {
 			Desc:   "show the member list of the current channel",
 			Handle: commandDoNames,
 		},
+		"NETWORK": {
+			AllowHome:    true,
+			AllowOffline: true,
+			Usage:        "[add <attr>=<value>... | change <network> <attr>=<value>...]",
+			Desc:         "show the networks of the bouncer, or add or change one",
+			Handle:       commandDoNetwork,
+		},
 		"PART": {
 			AllowHome: true,
 			Usage:     "[channel] [reason]",
 			Desc:      "part a channel",
 			Handle:    commandDoPart,
 		},
+		"QUIT": {
+			AllowHome:    true,
+			AllowOffline: true,
+			Usage:        "[reason]",
+			Desc:         "quit senpai",
+			Handle:       commandDoQuit,
+		},
 		"QUOTE": {
 			MinArgs:   1,
 			AllowHome: true,
@@ -71,6 +93,19 @@ func init() {
 			Desc:      "send raw protocol data",
 			Handle:    commandDoQuote,
 		},
+		"REACT": {
+			MinArgs:   1,
+			AllowHome: true,
+			Usage:     "<reaction>",
+			Desc:      "react to the selected message, such as with an emoji",
+			Handle:    commandDoReact,
+		},
+		"REDACT": {
+			AllowHome: true,
+			Usage:     "[reason]",
+			Desc:      "delete the selected message, which must be yours",
+			Handle:    commandDoRedact,
+		},
 		"R": {
 			AllowHome: true,
 			MinArgs:   1,
@@ -78,6 +113,13 @@ func init() {
 			Desc:      "reply to the last query",
 			Handle:    commandDoR,
 		},
+		"SETNAME": {
+			AllowHome: true,
+			MinArgs:   1,
+			Usage:     "<real name>",
+			Desc:      "change your real name",
+			Handle:    commandDoSetName,
+		},
 		"TOPIC": {
 			Usage:  "[topic]",
 			Desc:   "show or set the topic of the current channel",
@@ -86,27 +128,45 @@ func init() {
 	}
 }
 
-func commandDo(app *App, buffer string, args []string) (err error) {
-	app.s.PrivMsg(buffer, args[0])
-	if !app.s.HasCapability("echo-message") {
-		buffer, line, _ := app.formatMessage(irc.MessageEvent{
-			User:            &irc.Prefix{Name: app.s.Nick()},
+func commandDo(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	replyTo := app.takeReplyTo()
+	if replyTo != "" {
+		s.Reply(buffer, replyTo, args[0])
+	} else {
+		s.PrivMsg(buffer, args[0])
+	}
+	if !s.HasCapability("echo-message") {
+		buffer, line, _ := app.formatMessage(netID, irc.MessageEvent{
+			User:            &irc.Prefix{Name: s.Nick()},
 			Target:          buffer,
 			TargetIsChannel: true,
 			Command:         "PRIVMSG",
 			Content:         args[0],
 			Time:            time.Now(),
+			ReplyTo:         replyTo,
 		})
-		app.win.AddLine(buffer, false, line)
+		app.win.AddLine(netID, buffer, false, line)
 	}
 	return
 }
 
-func commandDoHelp(app *App, buffer string, args []string) (err error) {
+// takeReplyTo returns the msgid of the selected line, or "" if none is
+// selected, and clears the selection.
+func (app *App) takeReplyTo() string {
+	selected, ok := app.win.SelectedLine()
+	if !ok {
+		return ""
+	}
+	app.win.ClearSelection()
+	return selected.ID
+}
+
+func commandDoHelp(app *App, netID, buffer string, args []string) (err error) {
 	// TODO
 	t := time.Now()
 	if len(args) == 0 {
-		app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+		app.win.AddLine(netID, buffer, false, ui.Line{
 			At:   t,
 			Head: "--",
 			Body: "Available commands:",
@@ -115,22 +175,22 @@ func commandDoHelp(app *App, buffer string, args []string) (err error) {
 			if cmd.Desc == "" {
 				continue
 			}
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At:   t,
 				Body: fmt.Sprintf("  \x02%s\x02 %s", cmdName, cmd.Usage),
 			})
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At:   t,
 				Body: fmt.Sprintf("    %s", cmd.Desc),
 			})
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At: t,
 			})
 		}
 	} else {
 		search := strings.ToUpper(args[0])
 		found := false
-		app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+		app.win.AddLine(netID, buffer, false, ui.Line{
 			At:   t,
 			Head: "--",
 			Body: fmt.Sprintf("Commands that match \"%s\":", search),
@@ -139,21 +199,21 @@ func commandDoHelp(app *App, buffer string, args []string) (err error) {
 			if !strings.Contains(cmdName, search) {
 				continue
 			}
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At:   t,
 				Body: fmt.Sprintf("\x02%s\x02 %s", cmdName, cmd.Usage),
 			})
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At:   t,
 				Body: fmt.Sprintf("  %s", cmd.Desc),
 			})
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At: t,
 			})
 			found = true
 		}
 		if !found {
-			app.win.AddLine(app.win.CurrentBuffer(), false, ui.Line{
+			app.win.AddLine(netID, buffer, false, ui.Line{
 				At:   t,
 				Body: fmt.Sprintf("  no command matches %q", args[0]),
 			})
@@ -162,53 +222,119 @@ func commandDoHelp(app *App, buffer string, args []string) (err error) {
 	return
 }
 
-func commandDoJoin(app *App, buffer string, args []string) (err error) {
-	app.s.Join(args[0])
+func commandDoJoin(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	channel := args[0]
+	key := ""
+	if i := strings.IndexByte(channel, ' '); i != -1 {
+		key = strings.TrimSpace(channel[i+1:])
+		channel = channel[:i]
+	}
+	s.Join(channel, key)
 	return
 }
 
-func commandDoMe(app *App, buffer string, args []string) (err error) {
+func commandDoMe(app *App, netID, buffer string, args []string) (err error) {
+	replyTo := app.takeReplyTo()
 	if buffer == Home {
-		buffer = app.lastQuery
+		if replyTo != "" {
+			return fmt.Errorf("replies cannot be sent from home")
+		}
+		netID, buffer = app.lastQueryNet, app.lastQuery
+	}
+	s := app.session(netID)
+	if s == nil {
+		return fmt.Errorf("not connected to the server")
 	}
 	content := fmt.Sprintf("\x01ACTION %s\x01", args[0])
-	app.s.PrivMsg(buffer, content)
-	if !app.s.HasCapability("echo-message") {
-		buffer, line, _ := app.formatMessage(irc.MessageEvent{
-			User:            &irc.Prefix{Name: app.s.Nick()},
+	if replyTo != "" {
+		s.Reply(buffer, replyTo, content)
+	} else {
+		s.PrivMsg(buffer, content)
+	}
+	if !s.HasCapability("echo-message") {
+		buffer, line, _ := app.formatMessage(netID, irc.MessageEvent{
+			User:            &irc.Prefix{Name: s.Nick()},
 			Target:          buffer,
 			TargetIsChannel: true,
 			Command:         "PRIVMSG",
 			Content:         content,
 			Time:            time.Now(),
+			ReplyTo:         replyTo,
 		})
-		app.win.AddLine(buffer, false, line)
+		app.win.AddLine(netID, buffer, false, line)
 	}
 	return
 }
 
-func commandDoMsg(app *App, buffer string, args []string) (err error) {
+func commandDoMonitor(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	if len(args) == 0 {
+		var sb strings.Builder
+		sb.WriteString("\x0314Contacts:")
+		for _, c := range s.Contacts() {
+			sb.WriteRune(' ')
+			if c.Online {
+				sb.WriteString("\x033")
+			} else {
+				sb.WriteString("\x0314")
+			}
+			sb.WriteString(c.Name)
+		}
+		app.win.AddLine(netID, buffer, false, ui.Line{
+			At:   time.Now(),
+			Head: "--",
+			Body: sb.String(),
+		})
+		return
+	}
+
+	fields := strings.Fields(args[0])
+	if len(fields) < 2 {
+		return fmt.Errorf("usage: MONITOR [add|remove <nicks>]")
+	}
+	switch strings.ToLower(fields[0]) {
+	case "add":
+		s.Monitor(fields[1:]...)
+	case "remove":
+		s.Unmonitor(fields[1:]...)
+		for _, nick := range fields[1:] {
+			delete(app.networks[netID].presence, s.Casemap(nick))
+		}
+		app.updateContacts(netID, fields[1:]...)
+	default:
+		return fmt.Errorf("usage: MONITOR [add|remove <nicks>]")
+	}
+	return
+}
+
+func commandDoMsg(app *App, netID, buffer string, args []string) (err error) {
+	if app.takeReplyTo() != "" {
+		return fmt.Errorf("replies cannot be sent with MSG, send them from the buffer of the message")
+	}
+	s := app.session(netID)
 	target := args[0]
 	content := args[1]
-	app.s.PrivMsg(target, content)
-	if !app.s.HasCapability("echo-message") {
-		buffer, line, _ := app.formatMessage(irc.MessageEvent{
-			User:            &irc.Prefix{Name: app.s.Nick()},
+	s.PrivMsg(target, content)
+	if !s.HasCapability("echo-message") {
+		buffer, line, _ := app.formatMessage(netID, irc.MessageEvent{
+			User:            &irc.Prefix{Name: s.Nick()},
 			Target:          target,
 			TargetIsChannel: true,
 			Command:         "PRIVMSG",
 			Content:         content,
 			Time:            time.Now(),
 		})
-		app.win.AddLine(buffer, false, line)
+		app.win.AddLine(netID, buffer, false, line)
 	}
 	return
 }
 
-func commandDoNames(app *App, buffer string, args []string) (err error) {
+func commandDoNames(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
 	var sb strings.Builder
 	sb.WriteString("\x0314Names: ")
-	for _, name := range app.s.Names(buffer) {
+	for _, name := range s.Names(buffer) {
 		if name.PowerLevel != "" {
 			sb.WriteString("\x033")
 			sb.WriteString(name.PowerLevel)
@@ -218,7 +344,7 @@ func commandDoNames(app *App, buffer string, args []string) (err error) {
 		sb.WriteRune(' ')
 	}
 	body := sb.String()
-	app.win.AddLine(buffer, false, ui.Line{
+	app.win.AddLine(netID, buffer, false, ui.Line{
 		At:   time.Now(),
 		Head: "--",
 		Body: body[:len(body)-1],
@@ -226,11 +352,83 @@ func commandDoNames(app *App, buffer string, args []string) (err error) {
 	return
 }
 
-func commandDoPart(app *App, buffer string, args []string) (err error) {
+func commandDoNetwork(app *App, netID, buffer string, args []string) (err error) {
+	// Networks are managed through the main connection, which is not bound.
+	s := app.session("")
+	if s == nil || !s.HasCapability("soju.im/bouncer-networks") {
+		return fmt.Errorf("the server is not a bouncer that supports networks")
+	}
+
+	if len(args) == 0 {
+		var sb strings.Builder
+		sb.WriteString("\x0314Networks:")
+		for _, id := range app.networkIDs() {
+			n := app.networks[id]
+			sb.WriteRune(' ')
+			sb.WriteString(n.name())
+			if state := n.attrs["state"]; state != "" {
+				fmt.Fprintf(&sb, " (%s)", state)
+			}
+		}
+		app.win.AddLine(netID, buffer, false, ui.Line{
+			At:   time.Now(),
+			Head: "--",
+			Body: sb.String(),
+		})
+		return
+	}
+
+	usage := fmt.Errorf("usage: NETWORK [add <attr>=<value>... | change <network> <attr>=<value>...]")
+	fields := strings.Fields(args[0])
+	if len(fields) < 2 {
+		return usage
+	}
+	switch strings.ToLower(fields[0]) {
+	case "add":
+		attrs, err := parseNetworkAttrs(fields[1:])
+		if err != nil {
+			return err
+		}
+		s.AddNetwork(attrs)
+	case "change":
+		if len(fields) < 3 {
+			return usage
+		}
+		id, ok := app.networkID(fields[1])
+		if !ok {
+			return fmt.Errorf("no network is named %q", fields[1])
+		}
+		attrs, err := parseNetworkAttrs(fields[2:])
+		if err != nil {
+			return err
+		}
+		s.ChangeNetwork(id, attrs)
+	default:
+		return usage
+	}
+	return
+}
+
+// parseNetworkAttrs parses the attributes of a bouncer network given as
+// "name=value" fields, whose values contain "\s" instead of spaces.
+func parseNetworkAttrs(fields []string) (attrs map[string]string, err error) {
+	attrs = map[string]string{}
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) < 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid attribute %q, expected <attr>=<value>", f)
+		}
+		attrs[kv[0]] = strings.ReplaceAll(kv[1], `\s`, " ")
+	}
+	return
+}
+
+func commandDoPart(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
 	channel := buffer
 	reason := ""
 	if 0 < len(args) {
-		if app.s.IsChannel(args[0]) {
+		if s.IsChannel(args[0]) {
 			channel = args[0]
 			if 1 < len(args) {
 				reason = args[1]
@@ -241,51 +439,128 @@ func commandDoPart(app *App, buffer string, args []string) (err error) {
 	}
 
 	if channel != Home {
-		app.s.Part(channel, reason)
+		s.Part(channel, reason)
 	} else {
 		err = fmt.Errorf("cannot part home!")
 	}
 	return
 }
 
-func commandDoQuote(app *App, buffer string, args []string) (err error) {
-	app.s.SendRaw(args[0])
+func commandDoQuit(app *App, netID, buffer string, args []string) (err error) {
+	if 0 < len(args) {
+		app.quitReason = args[0]
+	}
+	app.win.Exit()
+	return
+}
+
+func commandDoQuote(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	s.SendRaw(args[0])
+	return
+}
+
+func commandDoReact(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	selected, ok := app.win.SelectedLine()
+	if !ok {
+		return fmt.Errorf("no message selected, select one with CTRL-UP")
+	}
+	if !s.HasCapability("message-tags") {
+		return fmt.Errorf("the server doesn't support reactions")
+	}
+	s.React(selectedTarget(buffer, selected), selected.ID, args[0])
+	app.win.ClearSelection()
+	if !s.HasCapability("echo-message") {
+		app.win.AddReaction(netID, buffer, selected.ID, s.Nick(), args[0])
+	}
+	return
+}
+
+// selectedTarget returns the target of the selected line of buffer, which is
+// the buffer itself unless it is the home buffer.
+func selectedTarget(buffer string, selected ui.Line) string {
+	if buffer == Home && selected.Target != "" {
+		return selected.Target
+	}
+	return buffer
+}
+
+func commandDoRedact(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	selected, ok := app.win.SelectedLine()
+	if !ok {
+		return fmt.Errorf("no message selected, select one with CTRL-UP")
+	}
+	if !selected.Own {
+		return fmt.Errorf("only your own messages can be deleted")
+	}
+	if !s.HasCapability("draft/message-redaction") {
+		return fmt.Errorf("the server doesn't support deleting messages")
+	}
+	ev := irc.RedactEvent{
+		Target: selectedTarget(buffer, selected),
+		MsgID:  selected.ID,
+	}
+	if 0 < len(args) {
+		ev.Reason = args[0]
+	}
+	s.Redact(ev.Target, ev.MsgID, ev.Reason)
+	app.win.ClearSelection()
+	if !s.HasCapability("echo-message") {
+		app.win.Redact(netID, buffer, ev.MsgID, redactedBody(ev))
+	}
 	return
 }
 
-func commandDoR(app *App, buffer string, args []string) (err error) {
-	app.s.PrivMsg(app.lastQuery, args[0])
-	if !app.s.HasCapability("echo-message") {
-		buffer, line, _ := app.formatMessage(irc.MessageEvent{
-			User:            &irc.Prefix{Name: app.s.Nick()},
+func commandDoR(app *App, netID, buffer string, args []string) (err error) {
+	netID = app.lastQueryNet
+	s := app.session(netID)
+	if s == nil {
+		return fmt.Errorf("not connected to the server")
+	}
+	s.PrivMsg(app.lastQuery, args[0])
+	if !s.HasCapability("echo-message") {
+		buffer, line, _ := app.formatMessage(netID, irc.MessageEvent{
+			User:            &irc.Prefix{Name: s.Nick()},
 			Target:          app.lastQuery,
 			TargetIsChannel: true,
 			Command:         "PRIVMSG",
 			Content:         args[0],
 			Time:            time.Now(),
 		})
-		app.win.AddLine(buffer, false, line)
+		app.win.AddLine(netID, buffer, false, line)
+	}
+	return
+}
+
+func commandDoSetName(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
+	if !s.HasCapability("setname") {
+		return fmt.Errorf("the server doesn't support changing your real name")
 	}
+	s.SetName(args[0])
 	return
 }
 
-func commandDoTopic(app *App, buffer string, args []string) (err error) {
+func commandDoTopic(app *App, netID, buffer string, args []string) (err error) {
+	s := app.session(netID)
 	if len(args) == 0 {
 		var body string
 
-		topic, who, at := app.s.Topic(buffer)
+		topic, who, at := s.Topic(buffer)
 		if who == nil {
 			body = fmt.Sprintf("\x0314Topic: %s", topic)
 		} else {
 			body = fmt.Sprintf("\x0314Topic (by %s, %s): %s", who, at.Local().Format("Mon Jan 2 15:04:05"), topic)
 		}
-		app.win.AddLine(buffer, false, ui.Line{
+		app.win.AddLine(netID, buffer, false, ui.Line{
 			At:   time.Now(),
 			Head: "--",
 			Body: body,
 		})
 	} else {
-		app.s.SetTopic(buffer, args[0])
+		s.SetTopic(buffer, args[0])
 	}
 	return
 }
@@ -311,7 +586,7 @@ func parseCommand(s string) (command, args string) {
 	return
 }
 
-func (app *App) handleInput(buffer, content string) error {
+func (app *App) handleInput(netID, buffer, content string) error {
 	cmdName, rawArgs := parseCommand(content)
 
 	cmd, ok := commands[cmdName]
@@ -334,6 +609,10 @@ func (app *App) handleInput(buffer, content string) error {
 	if buffer == Home && !cmd.AllowHome {
 		return fmt.Errorf("command %q cannot be executed from home", cmdName)
 	}
+	// The connection of the network may have failed.
+	if app.session(netID) == nil && !cmd.AllowOffline {
+		return fmt.Errorf("not connected to the server")
+	}
 
-	return cmd.Handle(app, buffer, args)
+	return cmd.Handle(app, netID, buffer, args)
 }
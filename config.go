@@ -1,28 +1,67 @@
 package senpai
 
 import (
+	"errors"
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// ServerConfig is an address senpai can connect to, and how to connect to it.
+type ServerConfig struct {
+	Addr string
+
+	// TLS is whether to use TLS.  Defaults to true, except for Unix domain
+	// sockets.  WebSocket URLs use TLS according to their scheme instead.
+	TLS           *bool
+	TLSSkipVerify bool `yaml:"tls-skip-verify"`
+}
+
 type Config struct {
 	Addr     string
+	Servers  []ServerConfig
 	Nick     string
 	Real     string
 	User     string
 	Password *string
+	Proxy    string
+
+	ServerPassword string   `yaml:"server-password"`
+	NickServ       bool     `yaml:"nickserv"`
+	SASLMechanisms []string `yaml:"sasl-mechanisms"`
 
 	Highlights   []string
 	OnHighlight  string `yaml:"on-highlight"`
 	NickColWidth int    `yaml:"nick-column-width"`
 	ChanColWidth int    `yaml:"chan-column-width"`
 
+	SendBurst int     `yaml:"send-burst"`
+	SendRate  float64 `yaml:"send-rate"`
+
+	PingInterval time.Duration `yaml:"ping-interval"`
+	PingTimeout  time.Duration `yaml:"ping-timeout"`
+
+	QuitMessage string `yaml:"quit-message"`
+
+	// Contacts are the users whose presence is monitored.
+	Contacts []string
+
 	Debug bool
 }
 
 func ParseConfig(buf []byte) (cfg Config, err error) {
 	err = yaml.Unmarshal(buf, &cfg)
+	if err != nil {
+		return
+	}
+	if cfg.Addr != "" {
+		cfg.Servers = append([]ServerConfig{{Addr: cfg.Addr}}, cfg.Servers...)
+	}
+	if len(cfg.Servers) == 0 {
+		err = errors.New("no server address specified (addr or servers)")
+		return
+	}
 	if cfg.NickColWidth <= 0 {
 		cfg.NickColWidth = 16
 	}
@@ -0,0 +1,97 @@
+package senpai
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// dial connects to srv, through the given proxy if any.  Addresses of the
+// form host:port are reached over TCP, unix:// URLs over a Unix domain socket,
+// and ws:// and wss:// URLs over WebSocket.
+func dial(proxy string, srv ServerConfig) (conn io.ReadWriteCloser, err error) {
+	if strings.HasPrefix(srv.Addr, "unix://") {
+		conn, err = net.Dial("unix", strings.TrimPrefix(srv.Addr, "unix://"))
+		if err != nil {
+			return
+		}
+		if srv.TLS != nil && *srv.TLS {
+			return startTLS(conn.(net.Conn), "localhost", srv)
+		}
+		return
+	}
+
+	d, err := newDialer(proxy)
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(srv.Addr, "ws://") || strings.HasPrefix(srv.Addr, "wss://") {
+		return dialWebsocket(d, srv)
+	}
+
+	return dialTCP(d, srv.Addr, srv)
+}
+
+// dialTCP connects to addr, over TLS unless srv disables it.
+func dialTCP(d dialer, addr string, srv ServerConfig) (conn net.Conn, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	conn, err = d.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	if srv.TLS != nil && !*srv.TLS {
+		return
+	}
+	return startTLS(conn, host, srv)
+}
+
+func startTLS(conn net.Conn, host string, srv ServerConfig) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: srv.TLSSkipVerify,
+	})
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func dialWebsocket(d dialer, srv ServerConfig) (ws *websocketConn, err error) {
+	u, err := url.Parse(srv.Addr)
+	if err != nil {
+		return
+	}
+
+	secure := u.Scheme == "wss"
+	srv.TLS = &secure
+
+	addr := u.Host
+	if u.Port() == "" && secure {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	} else if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := dialTCP(d, addr, srv)
+	if err != nil {
+		return
+	}
+
+	ws, err = newWebsocketConn(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return
+}
@@ -0,0 +1,78 @@
+package senpai
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "senpai")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "irc.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(":srv NOTICE * :hello\r\n"))
+	}()
+
+	conn, err := dial("socks5://unused:1080", ServerConfig{Addr: "unix://" + path})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(buf) != ":srv NOTICE * :hello\r\n" {
+		t.Errorf("expected to read the greeting of the server in clear, got %q", buf)
+	}
+}
+
+func TestParseConfigServers(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+nick: senpai
+addr: irc.example.org:6697
+servers:
+  - addr: unix:///run/soju.sock
+  - addr: irc2.example.org:6667
+    tls: false
+`))
+	if err != nil {
+		t.Fatalf("failed to parse the configuration: %v", err)
+	}
+
+	addrs := []string{"irc.example.org:6697", "unix:///run/soju.sock", "irc2.example.org:6667"}
+	if len(cfg.Servers) != len(addrs) {
+		t.Fatalf("expected %d servers, got %#v", len(addrs), cfg.Servers)
+	}
+	for i, addr := range addrs {
+		if cfg.Servers[i].Addr != addr {
+			t.Errorf("expected server #%d to be %q, got %q", i, addr, cfg.Servers[i].Addr)
+		}
+	}
+	if tls := cfg.Servers[2].TLS; tls == nil || *tls {
+		t.Errorf("expected TLS to be disabled for the last server")
+	}
+
+	_, err = ParseConfig([]byte("nick: senpai\n"))
+	if err == nil {
+		t.Errorf("expected a configuration without server to be rejected")
+	}
+}
@@ -14,6 +14,28 @@ type RawMessageEvent struct {
 
 type RegisteredEvent struct{}
 
+// LagEvent is sent each time the server answers one of the PINGs that are
+// periodically sent to it.
+type LagEvent struct {
+	Lag time.Duration
+}
+
+// STSUpgradeEvent is sent when the server advertises an STS policy on a
+// plaintext connection.  The session stops, and the client must reconnect to
+// the same host over TLS, on Port.
+type STSUpgradeEvent struct {
+	Port int
+}
+
+// STSPolicyEvent is sent when the server advertises an STS policy on a secure
+// connection.  For the next Duration, the client must only connect to this
+// host over TLS, on the port of the current connection.  A zero Duration
+// removes the policy.
+type STSPolicyEvent struct {
+	Duration time.Duration
+	Preload  bool
+}
+
 type SelfNickEvent struct {
 	FormerNick string
 	Time       time.Time
@@ -29,6 +51,32 @@ type SelfJoinEvent struct {
 	Channel string
 }
 
+// SetNameEvent is sent when a user, possibly the one of the session, changes
+// their real name.
+type SetNameEvent struct {
+	User     *Prefix
+	RealName string
+	Time     time.Time
+}
+
+// ChangeHostEvent is sent when the username or the host of a user, possibly
+// the one of the session, changes.  User holds the new ones.
+type ChangeHostEvent struct {
+	User       *Prefix
+	FormerUser string
+	FormerHost string
+	Time       time.Time
+}
+
+// ChannelRenameEvent is sent when a channel is renamed.  The channel keeps its
+// members and its topic.
+type ChannelRenameEvent struct {
+	FormerName string
+	Name       string
+	Reason     string
+	Time       time.Time
+}
+
 type UserJoinEvent struct {
 	User    *Prefix
 	Channel string
@@ -58,6 +106,14 @@ type TopicChangeEvent struct {
 	Time    time.Time
 }
 
+// PresenceEvent is sent when a monitored user comes online or goes offline,
+// and once for each of them when they start being monitored.  User only has
+// a name when the server doesn't give the rest of their prefix.
+type PresenceEvent struct {
+	User   *Prefix
+	Online bool
+}
+
 type MessageEvent struct {
 	User            *Prefix
 	Target          string
@@ -65,6 +121,12 @@ type MessageEvent struct {
 	Command         string
 	Content         string
 	Time            time.Time
+
+	// ID is the msgid of the message, if the server gave it one.
+	ID string
+
+	// ReplyTo is the msgid of the message this one replies to, if any.
+	ReplyTo string
 }
 
 type TagEvent struct {
@@ -75,7 +137,56 @@ type TagEvent struct {
 	Time            time.Time
 }
 
+// ReactionEvent is sent when a user reacts to a message, such as with an
+// emoji.  MsgID is the msgid of the message, and Reaction the reaction itself.
+type ReactionEvent struct {
+	User            *Prefix
+	Target          string
+	TargetIsChannel bool
+	MsgID           string
+	Reaction        string
+	Time            time.Time
+}
+
+// RedactEvent is sent when a user deletes a message, whose msgid is MsgID.
+type RedactEvent struct {
+	User            *Prefix
+	Target          string
+	TargetIsChannel bool
+	MsgID           string
+	Reason          string
+	Time            time.Time
+}
+
+// ReadMarkerEvent is sent when the server tells the time of the last message
+// of Target that has been read, by this or another client of the same user.
+// Time is zero if no message has been read yet.
+type ReadMarkerEvent struct {
+	Target string
+	Time   time.Time
+}
+
+// BouncerNetworkEvent is sent when the bouncer lists one of its networks, or
+// when one is added, changed or deleted (soju.im/bouncer-networks extension).
+// Attrs only contains the attributes that have changed, and Deleted is true if
+// the network has been deleted.
+type BouncerNetworkEvent struct {
+	ID      string
+	Attrs   map[string]string
+	Deleted bool
+}
+
 type HistoryEvent struct {
 	Target   string
 	Messages []Event
 }
+
+// BatchEvent is a BATCH that has been closed by the server.  Children contains,
+// in order of arrival, the Messages and the nested BatchEvents it enclosed.
+// Tags are the tags of the message that opened it.
+type BatchEvent struct {
+	Type     string
+	Params   []string
+	Tags     map[string]string
+	Children []Event
+}
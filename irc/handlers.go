@@ -0,0 +1,208 @@
+package irc
+
+// MessageHandler processes a message received from the server.
+type MessageHandler func(msg Message) error
+
+// Middleware wraps the processing of the messages received from the server.
+// It can inspect, modify or drop a message before passing it to next, which
+// updates the state of the session and emits the corresponding events.
+//
+// Middlewares run on the goroutine of the session, without holding its lock:
+// they may read its state through its exported methods, but must not block.
+type Middleware func(next MessageHandler) MessageHandler
+
+// Handler is called for each event of a session by Session.Dispatch.
+type Handler interface {
+	HandleEvent(s *Session, ev Event)
+}
+
+// HandlerFunc is a function that can be used as a Handler.
+type HandlerFunc func(s *Session, ev Event)
+
+func (f HandlerFunc) HandleEvent(s *Session, ev Event) {
+	f(s, ev)
+}
+
+// Handlers is a Handler that calls the callback matching the type of each
+// event.  Callbacks that are nil are skipped.  Events that have no callback,
+// including those of types unknown to Handlers, are passed to Default.
+type Handlers struct {
+	Registered  func(s *Session, ev RegisteredEvent)
+	Lag         func(s *Session, ev LagEvent)
+	STSUpgrade  func(s *Session, ev STSUpgradeEvent)
+	STSPolicy   func(s *Session, ev STSPolicyEvent)
+	SelfNick    func(s *Session, ev SelfNickEvent)
+	UserNick    func(s *Session, ev UserNickEvent)
+	SetName     func(s *Session, ev SetNameEvent)
+	ChangeHost  func(s *Session, ev ChangeHostEvent)
+	SelfJoin    func(s *Session, ev SelfJoinEvent)
+	UserJoin    func(s *Session, ev UserJoinEvent)
+	SelfPart    func(s *Session, ev SelfPartEvent)
+	UserPart    func(s *Session, ev UserPartEvent)
+	UserQuit    func(s *Session, ev UserQuitEvent)
+	TopicChange func(s *Session, ev TopicChangeEvent)
+	Rename      func(s *Session, ev ChannelRenameEvent)
+	Presence    func(s *Session, ev PresenceEvent)
+	Message     func(s *Session, ev MessageEvent)
+	Tag         func(s *Session, ev TagEvent)
+	Reaction    func(s *Session, ev ReactionEvent)
+	Redact      func(s *Session, ev RedactEvent)
+	ReadMarker  func(s *Session, ev ReadMarkerEvent)
+	Network     func(s *Session, ev BouncerNetworkEvent)
+	History     func(s *Session, ev HistoryEvent)
+	Batch       func(s *Session, ev BatchEvent)
+	RawMessage  func(s *Session, ev RawMessageEvent)
+	Error       func(s *Session, err error)
+
+	Default func(s *Session, ev Event)
+}
+
+func (h *Handlers) HandleEvent(s *Session, ev Event) {
+	handled := false
+
+	switch ev := ev.(type) {
+	case RegisteredEvent:
+		if h.Registered != nil {
+			h.Registered(s, ev)
+			handled = true
+		}
+	case LagEvent:
+		if h.Lag != nil {
+			h.Lag(s, ev)
+			handled = true
+		}
+	case STSUpgradeEvent:
+		if h.STSUpgrade != nil {
+			h.STSUpgrade(s, ev)
+			handled = true
+		}
+	case STSPolicyEvent:
+		if h.STSPolicy != nil {
+			h.STSPolicy(s, ev)
+			handled = true
+		}
+	case SelfNickEvent:
+		if h.SelfNick != nil {
+			h.SelfNick(s, ev)
+			handled = true
+		}
+	case UserNickEvent:
+		if h.UserNick != nil {
+			h.UserNick(s, ev)
+			handled = true
+		}
+	case SetNameEvent:
+		if h.SetName != nil {
+			h.SetName(s, ev)
+			handled = true
+		}
+	case ChangeHostEvent:
+		if h.ChangeHost != nil {
+			h.ChangeHost(s, ev)
+			handled = true
+		}
+	case SelfJoinEvent:
+		if h.SelfJoin != nil {
+			h.SelfJoin(s, ev)
+			handled = true
+		}
+	case UserJoinEvent:
+		if h.UserJoin != nil {
+			h.UserJoin(s, ev)
+			handled = true
+		}
+	case SelfPartEvent:
+		if h.SelfPart != nil {
+			h.SelfPart(s, ev)
+			handled = true
+		}
+	case UserPartEvent:
+		if h.UserPart != nil {
+			h.UserPart(s, ev)
+			handled = true
+		}
+	case UserQuitEvent:
+		if h.UserQuit != nil {
+			h.UserQuit(s, ev)
+			handled = true
+		}
+	case TopicChangeEvent:
+		if h.TopicChange != nil {
+			h.TopicChange(s, ev)
+			handled = true
+		}
+	case ChannelRenameEvent:
+		if h.Rename != nil {
+			h.Rename(s, ev)
+			handled = true
+		}
+	case PresenceEvent:
+		if h.Presence != nil {
+			h.Presence(s, ev)
+			handled = true
+		}
+	case MessageEvent:
+		if h.Message != nil {
+			h.Message(s, ev)
+			handled = true
+		}
+	case TagEvent:
+		if h.Tag != nil {
+			h.Tag(s, ev)
+			handled = true
+		}
+	case ReactionEvent:
+		if h.Reaction != nil {
+			h.Reaction(s, ev)
+			handled = true
+		}
+	case RedactEvent:
+		if h.Redact != nil {
+			h.Redact(s, ev)
+			handled = true
+		}
+	case ReadMarkerEvent:
+		if h.ReadMarker != nil {
+			h.ReadMarker(s, ev)
+			handled = true
+		}
+	case BouncerNetworkEvent:
+		if h.Network != nil {
+			h.Network(s, ev)
+			handled = true
+		}
+	case HistoryEvent:
+		if h.History != nil {
+			h.History(s, ev)
+			handled = true
+		}
+	case BatchEvent:
+		if h.Batch != nil {
+			h.Batch(s, ev)
+			handled = true
+		}
+	case RawMessageEvent:
+		if h.RawMessage != nil {
+			h.RawMessage(s, ev)
+			handled = true
+		}
+	case error:
+		if h.Error != nil {
+			h.Error(s, ev)
+			handled = true
+		}
+	}
+
+	if !handled && h.Default != nil {
+		h.Default(s, ev)
+	}
+}
+
+// Dispatch passes the events of the session to h, in order, until the session
+// is stopped and all its events have been handled.  It must not be used
+// along with Poll.
+func (s *Session) Dispatch(h Handler) {
+	for ev := range s.Poll() {
+		h.HandleEvent(s, ev)
+	}
+}
@@ -0,0 +1,407 @@
+// Package irctest provides a fake IRC server to test IRC clients, such as
+// irc.Session, without network access.
+package irctest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~taiite/senpai/irc"
+)
+
+// Name is the name of the fake server, used as the prefix of its messages.
+const Name = "irctest"
+
+// Server is a fake IRC server that talks to a single client over net.Pipe.
+// The test drives the conversation: it sends lines with Send and checks what
+// the client sends with Expect.  Unless noted otherwise, methods fail the test
+// when the client doesn't behave as expected.
+type Server struct {
+	// Caps is the list of capabilities advertised in CAP LS, mapped to their
+	// values.  Requests for other capabilities are rejected.
+	Caps map[string]string
+
+	// Accounts maps the usernames accepted during SASL PLAIN authentication
+	// to their passwords.
+	Accounts map[string]string
+
+	// ExternalAccount is the account the client logs in as with SASL
+	// EXTERNAL.  If empty, SASL EXTERNAL fails.
+	ExternalAccount string
+
+	// ISupport is the list of tokens sent in RPL_ISUPPORT after registration.
+	ISupport []string
+
+	// Timeout is how long to wait for a line from the client.  Defaults to 5
+	// seconds.
+	Timeout time.Duration
+
+	// Nick is the nickname of the client, as sent during registration.
+	Nick string
+
+	// Password is the server password sent by the client with PASS during
+	// registration, if any.
+	Password string
+
+	// NetID is the bouncer network the client has bound to with BOUNCER BIND
+	// during registration, if any.
+	NetID string
+
+	t       testing.TB
+	conn    net.Conn
+	lines   chan string
+	pending []string
+	syncID  int
+	batchID int
+}
+
+// NewServer starts a fake server.  The client must use the returned
+// connection.
+func NewServer(t testing.TB) (s *Server, client net.Conn) {
+	client, conn := net.Pipe()
+	s = &Server{
+		Caps:     map[string]string{},
+		Accounts: map[string]string{},
+		Timeout:  5 * time.Second,
+		t:        t,
+		conn:     conn,
+		lines:    make(chan string, 256),
+	}
+
+	go func() {
+		defer close(s.lines)
+		r := bufio.NewScanner(conn)
+		for r.Scan() {
+			s.lines <- r.Text()
+		}
+	}()
+
+	return s, client
+}
+
+// Close closes the connection.
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// Send sends the given lines to the client, in order.
+func (s *Server) Send(lines ...string) {
+	s.t.Helper()
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	if err != nil {
+		s.t.Fatalf("failed to send to the client: %v", err)
+	}
+}
+
+// Sendf sends a single formatted line to the client.
+func (s *Server) Sendf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.Send(fmt.Sprintf(format, args...))
+}
+
+// Reply sends a numeric reply to the client, prefixed by the name of the
+// server and the nickname of the client.
+func (s *Server) Reply(numeric string, params ...string) {
+	s.t.Helper()
+
+	msg := irc.NewMessage(numeric, append([]string{s.Nick}, params...)...)
+	msg.Prefix = &irc.Prefix{Name: Name}
+	s.Send(msg.String())
+}
+
+// NextLine returns the next line sent by the client.
+func (s *Server) NextLine() string {
+	s.t.Helper()
+
+	if 0 < len(s.pending) {
+		line := s.pending[0]
+		s.pending = s.pending[1:]
+		return line
+	}
+
+	select {
+	case line, ok := <-s.lines:
+		if !ok {
+			s.t.Fatalf("the client closed the connection")
+		}
+		return line
+	case <-time.After(s.Timeout):
+		s.t.Fatalf("timed out waiting for the client")
+	}
+	return ""
+}
+
+// Next returns the next message sent by the client.
+func (s *Server) Next() irc.Message {
+	s.t.Helper()
+
+	line := s.NextLine()
+	msg, err := irc.ParseMessage(line)
+	if err != nil {
+		s.t.Fatalf("the client sent an invalid message %q: %v", line, err)
+	}
+	return msg
+}
+
+// Expect checks that the next message sent by the client is line.  Messages
+// are compared once parsed, so that "PART #a :bye" matches "PART #a bye".
+func (s *Server) Expect(line string) {
+	s.t.Helper()
+
+	expected, err := irc.ParseMessage(line)
+	if err != nil {
+		s.t.Fatalf("invalid expected message %q: %v", line, err)
+	}
+	actual := s.Next()
+	if !reflect.DeepEqual(actual, expected) {
+		s.t.Fatalf("expected the client to send %q, got %q", line, actual.String())
+	}
+}
+
+// ExpectCommand checks that the next message sent by the client has one of the
+// given commands, and returns it.
+func (s *Server) ExpectCommand(commands ...string) irc.Message {
+	s.t.Helper()
+
+	msg := s.Next()
+	for _, command := range commands {
+		if msg.Command == command {
+			return msg
+		}
+	}
+	s.t.Fatalf("expected the client to send %s, got %q", strings.Join(commands, " or "), msg.String())
+	return msg
+}
+
+// ExpectClosed checks that the client closes the connection without sending
+// anything else.
+func (s *Server) ExpectClosed() {
+	s.t.Helper()
+
+	if 0 < len(s.pending) {
+		s.t.Fatalf("expected the client to close the connection, got %q", s.pending[0])
+	}
+	select {
+	case line, ok := <-s.lines:
+		if ok {
+			s.t.Fatalf("expected the client to close the connection, got %q", line)
+		}
+	case <-time.After(s.Timeout):
+		s.t.Fatalf("timed out waiting for the client to close the connection")
+	}
+}
+
+// Sync waits until the client has processed everything that has been sent to
+// it, by sending a PING and waiting for its PONG.  Lines received in between
+// are kept for the next calls to Next and Expect.
+func (s *Server) Sync() {
+	s.t.Helper()
+
+	s.syncID++
+	token := fmt.Sprintf("irctest-sync-%d", s.syncID)
+	s.Sendf("PING %s", token)
+
+	var lines []string
+	for {
+		line := s.NextLine()
+		msg, err := irc.ParseMessage(line)
+		if err == nil && msg.Command == "PONG" && 0 < len(msg.Params) && msg.Params[len(msg.Params)-1] == token {
+			break
+		}
+		lines = append(lines, line)
+	}
+	s.pending = append(s.pending, lines...)
+}
+
+// Register goes through the registration of the client: it records the server
+// password if the client sends one, answers CAP LS with Caps, acknowledges the
+// capabilities requested by the client, authenticates it with SASL if it asks
+// to, records the bouncer network it binds to, and welcomes it once it has
+// sent CAP END.  It returns the capabilities that have been enabled.
+func (s *Server) Register() (enabled []string) {
+	s.t.Helper()
+
+	msg := s.ExpectCommand("PASS", "CAP")
+	if msg.Command == "PASS" {
+		s.Password = msg.Params[0]
+		msg = s.ExpectCommand("CAP")
+	}
+	if strings.Join(msg.Params, " ") != "LS 302" {
+		s.t.Fatalf("expected the client to send CAP LS 302, got %q", msg.String())
+	}
+	s.Nick = s.ExpectCommand("NICK").Params[0]
+	s.ExpectCommand("USER")
+
+	var ls []string
+	for c, v := range s.Caps {
+		if v != "" {
+			c += "=" + v
+		}
+		ls = append(ls, c)
+	}
+	s.Sendf(":%s CAP * LS :%s", Name, strings.Join(ls, " "))
+
+	for {
+		msg = s.ExpectCommand("CAP", "AUTHENTICATE", "BOUNCER")
+		if msg.Command == "AUTHENTICATE" {
+			s.authenticate(msg)
+			continue
+		}
+		if msg.Command == "BOUNCER" {
+			if len(msg.Params) < 2 || msg.Params[0] != "BIND" {
+				s.t.Fatalf("unexpected BOUNCER message %q during registration", msg.String())
+			}
+			s.NetID = msg.Params[1]
+			continue
+		}
+
+		sub := strings.ToUpper(msg.Params[0])
+		if sub == "END" {
+			break
+		}
+		if sub != "REQ" || len(msg.Params) < 2 {
+			s.t.Fatalf("unexpected CAP message %q during registration", msg.String())
+		}
+
+		req := msg.Params[1]
+		ack := "ACK"
+		for _, c := range strings.Fields(req) {
+			if _, ok := s.Caps[strings.TrimPrefix(c, "-")]; !ok {
+				ack = "NAK"
+			}
+		}
+		if ack == "ACK" {
+			enabled = append(enabled, strings.Fields(req)...)
+		}
+		s.Sendf(":%s CAP * %s :%s", Name, ack, req)
+	}
+
+	s.Reply("001", "Welcome to irctest, "+s.Nick)
+	if 0 < len(s.ISupport) {
+		params := append([]string{}, s.ISupport...)
+		s.Reply("005", append(params, "are supported by this server")...)
+	}
+
+	return
+}
+
+// Authenticate goes through a SASL authentication started by the client.  The
+// mechanisms supported are PLAIN, checked against Accounts, and EXTERNAL,
+// which logs in as ExternalAccount.  Only the mechanisms listed in the value
+// of the sasl capability are accepted, if it has one.
+func (s *Server) Authenticate() {
+	s.t.Helper()
+	s.authenticate(s.ExpectCommand("AUTHENTICATE"))
+}
+
+func (s *Server) authenticate(msg irc.Message) {
+	s.t.Helper()
+
+	mechs := []string{"PLAIN", "EXTERNAL"}
+	if v := s.Caps["sasl"]; v != "" {
+		mechs = strings.Split(v, ",")
+	}
+	mech := msg.Params[0]
+	supported := false
+	for _, m := range mechs {
+		supported = supported || m == mech
+	}
+	if !supported {
+		s.Reply("908", strings.Join(mechs, ","), "are available SASL mechanisms")
+		s.Reply("904", "SASL authentication failed")
+		return
+	}
+	s.Send("AUTHENTICATE +")
+
+	msg = s.ExpectCommand("AUTHENTICATE")
+	if msg.Params[0] == "*" {
+		s.Reply("906", "SASL authentication aborted")
+		return
+	}
+
+	var account string
+	switch mech {
+	case "EXTERNAL":
+		account = s.ExternalAccount
+	case "PLAIN":
+		buf, err := base64.StdEncoding.DecodeString(msg.Params[0])
+		if err != nil {
+			s.t.Fatalf("the client sent invalid base64 %q: %v", msg.Params[0], err)
+		}
+		creds := strings.Split(string(buf), "\x00")
+		if len(creds) != 3 {
+			s.t.Fatalf("the client sent invalid SASL PLAIN credentials %q", buf)
+		}
+
+		user, pass := creds[1], creds[2]
+		if expected, ok := s.Accounts[user]; ok && pass == expected {
+			account = user
+		}
+	}
+
+	if account == "" {
+		s.Reply("904", "SASL authentication failed")
+		return
+	}
+	s.Reply("900", fmt.Sprintf("%s!%s@irctest.localhost", s.Nick, account), account, "You are now logged in as "+account)
+	s.Reply("903", "SASL authentication successful")
+}
+
+// Join makes the client join channel: it sends the JOIN, the topic if not
+// empty, and the list of members.  The members must include the client and
+// may be prefixed with their membership prefixes, such as "@".
+func (s *Server) Join(channel, topic string, members ...string) {
+	s.t.Helper()
+
+	s.Sendf(":%s!%s@irctest.localhost JOIN %s", s.Nick, s.Nick, channel)
+	if topic != "" {
+		s.Reply("332", channel, topic)
+	}
+	s.Reply("353", "=", channel, strings.Join(members, " "))
+	s.Reply("366", channel, "End of /NAMES list")
+}
+
+// SendHistory sends lines to the client in a chathistory batch for target.
+// Lines may have tags of their own.
+func (s *Server) SendHistory(target string, lines ...string) {
+	s.t.Helper()
+
+	s.batchID++
+	id := fmt.Sprintf("irctest%d", s.batchID)
+
+	batch := make([]string, 0, len(lines)+2)
+	batch = append(batch, fmt.Sprintf(":%s BATCH +%s chathistory %s", Name, id, target))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "@") {
+			line = "@batch=" + id + ";" + line[1:]
+		} else {
+			line = "@batch=" + id + " " + line
+		}
+		batch = append(batch, line)
+	}
+	batch = append(batch, fmt.Sprintf(":%s BATCH -%s", Name, id))
+
+	s.Send(batch...)
+}
+
+// Discard reads and drops everything the client sends, until the connection
+// is closed.  The server cannot be used afterwards, except for Send.
+func (s *Server) Discard() {
+	go func() {
+		for range s.lines {
+		}
+	}()
+}
@@ -0,0 +1,255 @@
+package irc
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// sendQueue writes lines to the connection without exceeding the rate allowed
+// by the server.  It uses a token bucket: up to burst lines can be written at
+// once, then lines are written at rate lines per second.  Urgent lines are
+// written before the others and are not delayed.
+type sendQueue struct {
+	w     io.Writer
+	burst float64
+	rate  float64
+	wake  chan struct{}
+	done  chan struct{}
+	clock clock
+
+	l      sync.Mutex
+	urgent []string
+	lines  []string
+	tokens float64
+	last   time.Time
+	err    error
+}
+
+// clock is the source of time of a sendQueue.  Tests replace it with one they
+// control.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func newSendQueue(w io.Writer, burst int, rate float64) *sendQueue {
+	return newSendQueueClock(w, burst, rate, realClock{})
+}
+
+func newSendQueueClock(w io.Writer, burst int, rate float64, c clock) *sendQueue {
+	q := &sendQueue{
+		w:      w,
+		burst:  float64(burst),
+		rate:   rate,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		clock:  c,
+		tokens: float64(burst),
+		last:   c.Now(),
+	}
+	go q.run()
+	return q
+}
+
+// Push appends lines to the queue.  It returns the error that stopped the
+// queue, if any.
+func (q *sendQueue) Push(urgent bool, lines ...string) error {
+	q.l.Lock()
+	if q.err != nil {
+		q.l.Unlock()
+		return q.err
+	}
+	if urgent {
+		q.urgent = append(q.urgent, lines...)
+	} else {
+		q.lines = append(q.lines, lines...)
+	}
+	q.l.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of lines that have not been written yet.
+func (q *sendQueue) Len() int {
+	q.l.Lock()
+	defer q.l.Unlock()
+	return len(q.urgent) + len(q.lines)
+}
+
+// Close stops the queue.  Lines that have not been written yet are dropped.
+func (q *sendQueue) Close() {
+	q.l.Lock()
+	defer q.l.Unlock()
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
+}
+
+func (q *sendQueue) run() {
+	for {
+		line, wait, ok := q.next()
+		if ok {
+			_, err := io.WriteString(q.w, line+"\r\n")
+			if err != nil {
+				q.l.Lock()
+				q.err = err
+				q.l.Unlock()
+				return
+			}
+			continue
+		}
+
+		var timeout <-chan time.Time
+		if 0 < wait {
+			timeout = q.clock.After(wait)
+		}
+		select {
+		case <-q.wake:
+		case <-timeout:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// next pops the next line that can be written now.  If there is none, it
+// returns how long to wait before the next one can be written, or 0 if the
+// queue is empty.
+func (q *sendQueue) next() (line string, wait time.Duration, ok bool) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	now := q.clock.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.burst < q.tokens || q.rate <= 0 {
+		q.tokens = q.burst
+	}
+	q.last = now
+
+	if 0 < len(q.urgent) {
+		line = q.urgent[0]
+		q.urgent = q.urgent[1:]
+	} else if 0 < len(q.lines) && 1 <= q.tokens {
+		line = q.lines[0]
+		q.lines = q.lines[1:]
+	} else if 0 < len(q.lines) {
+		wait = time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+		return
+	} else {
+		return
+	}
+
+	q.tokens--
+	ok = true
+	return
+}
+
+// eventQueue delivers events to a channel without ever blocking the sender:
+// events are kept in memory for as long as the consumer is busy.  Once the
+// consumer has given up on the events, Discard must be called so that the
+// queue stops delivering them.
+type eventQueue struct {
+	out     chan Event
+	wake    chan struct{}
+	gone    chan struct{}
+	discard sync.Once
+
+	l      sync.Mutex
+	evs    []Event
+	closed bool
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		out:  make(chan Event, 64),
+		wake: make(chan struct{}, 1),
+		gone: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Out returns the channel events are delivered to.  It is closed after Close
+// has been called and all events have been delivered, or after Discard has
+// been called.
+func (q *eventQueue) Out() <-chan Event {
+	return q.out
+}
+
+func (q *eventQueue) Push(ev Event) {
+	q.l.Lock()
+	q.evs = append(q.evs, ev)
+	q.l.Unlock()
+	q.signal()
+}
+
+func (q *eventQueue) Close() {
+	q.l.Lock()
+	q.closed = true
+	q.l.Unlock()
+	q.signal()
+}
+
+// Discard drops the events that have not been delivered yet and closes Out
+// without waiting for the consumer.
+func (q *eventQueue) Discard() {
+	q.discard.Do(func() {
+		close(q.gone)
+	})
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) run() {
+	defer close(q.out)
+
+	for {
+		q.l.Lock()
+		evs := q.evs
+		q.evs = nil
+		closed := q.closed
+		q.l.Unlock()
+
+		if len(evs) == 0 {
+			if closed {
+				return
+			}
+			select {
+			case <-q.wake:
+			case <-q.gone:
+				return
+			}
+			continue
+		}
+
+		for _, ev := range evs {
+			select {
+			case q.out <- ev:
+			case <-q.gone:
+				return
+			}
+		}
+	}
+}
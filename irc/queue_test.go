@@ -0,0 +1,147 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lineRecorder struct {
+	l     sync.Mutex
+	lines []string
+}
+
+func (r *lineRecorder) Write(p []byte) (n int, err error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.lines = append(r.lines, strings.TrimSuffix(string(p), "\r\n"))
+	return len(p), nil
+}
+
+func (r *lineRecorder) Lines() string {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return strings.Join(r.lines, " ")
+}
+
+// fakeClock is a clock that only moves forward when told to.
+type fakeClock struct {
+	l      sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+// Advance moves the clock forward by d, once the queue is waiting for it, and
+// fires the timers that expire.
+func (c *fakeClock) Advance(t *testing.T, d time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.l.Lock()
+		n := len(c.timers)
+		c.l.Unlock()
+		if n != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the queue to wait for the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+// expectLines waits until the recorder has received the expected lines.
+func expectLines(t *testing.T, r *lineRecorder, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Lines() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the lines %q to be sent, got %q", expected, r.Lines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	var r lineRecorder
+	clock := &fakeClock{now: time.Now()}
+	q := newSendQueueClock(&r, 2, 20, clock)
+	defer q.Close()
+
+	// The clock doesn't move, so only the burst is sent.
+	_ = q.Push(false, "1", "2", "3", "4")
+	expectLines(t, &r, "1 2")
+	if n := q.Len(); n != 2 {
+		t.Errorf("expected 2 lines to be queued, got %d", n)
+	}
+
+	_ = q.Push(true, "PONG")
+	expectLines(t, &r, "1 2 PONG")
+
+	// The urgent line used a token, so three are needed, earned in 150ms.
+	clock.Advance(t, 100*time.Millisecond)
+	expectLines(t, &r, "1 2 PONG 3")
+	clock.Advance(t, 50*time.Millisecond)
+	expectLines(t, &r, "1 2 PONG 3 4")
+}
+
+func TestEventQueueDiscard(t *testing.T) {
+	q := newEventQueue()
+	for i := 0; i < 100; i++ {
+		q.Push(i)
+	}
+	q.Close()
+
+	// The consumer gives up: the events that don't fit in the channel are
+	// dropped and the channel is closed.
+	q.Discard()
+	n := 0
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-q.Out():
+			if !ok {
+				if n == 100 {
+					t.Errorf("expected some events to be dropped")
+				}
+				return
+			}
+			n++
+		case <-timeout:
+			t.Fatal("expected the queue to close its channel after Discard")
+		}
+	}
+}
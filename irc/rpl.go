@@ -86,6 +86,19 @@ const (
 
 	errUmodeunknownflag = "501" // :Unknown mode flag
 	errUsersdontmatch   = "502" // :Can't change mode for other users
+	errToomanywatch     = "512" // <nick> :Maximum size for WATCH-list is <limit> entries
+
+	rplLogon    = "600" // <nick> <user> <host> <signon> :logged online
+	rplLogoff   = "601" // <nick> <user> <host> <signon> :logged offline
+	rplWatchoff = "602" // <nick> <user> <host> <signon> :stopped watching
+	rplNowon    = "604" // <nick> <user> <host> <signon> :is online
+	rplNowoff   = "605" // <nick> <user> <host> <signon> :is offline
+
+	rplMononline    = "730" // :target[!user@host][,target[!user@host]]*
+	rplMonoffline   = "731" // :target[,target2]*
+	rplMonlist      = "732" // :target[,target2]*
+	rplEndofmonlist = "733" // :End of MONITOR list
+	errMonlistfull  = "734" // <limit> <targets> :Monitor list is full.
 
 	rplLoggedin    = "900" // <nick> <nick>!<ident>@<host> <account> :You are now logged in as <user>
 	rplLoggedout   = "901" // <nick> <nick>!<ident>@<host> :You are now logged out
@@ -0,0 +1,1059 @@
+package irc_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~taiite/senpai/irc"
+	"git.sr.ht/~taiite/senpai/irc/irctest"
+)
+
+// newSession creates a session connected to a fake server, which are both
+// closed at the end of the test.  Unless set in params, the nickname is
+// "senpai" and flood protection is disabled.
+func newSession(t *testing.T, params irc.SessionParams) (*irctest.Server, *irc.Session) {
+	t.Helper()
+
+	srv, client := irctest.NewServer(t)
+	t.Cleanup(func() { srv.Close() })
+	if params.Nickname == "" {
+		params.Nickname = "senpai"
+	}
+	if params.SendRate == 0 {
+		params.SendRate = -1
+	}
+
+	s, err := irc.NewSession(client, params)
+	if err != nil {
+		t.Fatalf("failed to create the session: %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return srv, s
+}
+
+// newRegisteredSession is like newSession, and registers the session with a
+// server that advertises caps, given as in CAP LS ("name" or "name=value").
+// The session doesn't log in, so it sends WHO to learn its host.
+func newRegisteredSession(t *testing.T, params irc.SessionParams, caps ...string) (*irctest.Server, *irc.Session) {
+	t.Helper()
+
+	srv, s := newSession(t, params)
+	for _, c := range caps {
+		name, value := c, ""
+		if i := strings.IndexByte(c, '='); i != -1 {
+			name, value = c[:i], c[i+1:]
+		}
+		srv.Caps[name] = value
+	}
+	srv.Register()
+	srv.Expect("WHO senpai")
+	return srv, s
+}
+
+// events stops the session and returns the events it emitted.
+func events(s *irc.Session) (evs []irc.Event) {
+	s.Stop()
+	for ev := range s.Poll() {
+		evs = append(evs, ev)
+	}
+	return
+}
+
+func names(s *irc.Session, channel string) string {
+	var names []string
+	for _, m := range s.Names(channel) {
+		names = append(names, m.PowerLevel+m.Name.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func assertNames(t *testing.T, s *irc.Session, channel, expected string) {
+	t.Helper()
+	if actual := names(s, channel); actual != expected {
+		t.Errorf("expected the members of %s to be %q, got %q", channel, expected, actual)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{
+		Auth: &irc.SASLPlain{Username: "senpai", Password: "hunter2"},
+	})
+	srv.Caps["sasl"] = "PLAIN"
+	srv.Caps["message-tags"] = ""
+	srv.Caps["unsupported-cap"] = ""
+	srv.Accounts["senpai"] = "hunter2"
+	srv.ISupport = []string{"CASEMAPPING=ascii", "LINELEN=1024"}
+
+	enabled := srv.Register()
+	sort.Strings(enabled)
+	if strings.Join(enabled, " ") != "message-tags sasl" {
+		t.Errorf("expected the session to request message-tags and sasl, got %q", enabled)
+	}
+	srv.Sync()
+
+	if !s.HasCapability("message-tags") {
+		t.Errorf("expected message-tags to be enabled")
+	}
+	if s.HasCapability("unsupported-cap") {
+		t.Errorf("expected unsupported-cap not to be enabled")
+	}
+	if s.Nick() != "senpai" {
+		t.Errorf("expected nick to be %q, got %q", "senpai", s.Nick())
+	}
+	// LINELEN, minus the prefix given by RPL_LOGGEDIN, the target and the
+	// punctuation.
+	if max := s.MaxContentLen("#a"); max != 1024-len("senpaisenpaiirctest.localhost#a")-17 {
+		t.Errorf("expected the max content length to be computed from LINELEN, got %d", max)
+	}
+
+	evs := events(s)
+	if len(evs) != 1 {
+		t.Fatalf("expected a single event, got %#v", evs)
+	}
+	if _, ok := evs[0].(irc.RegisteredEvent); !ok {
+		t.Errorf("expected a RegisteredEvent, got %#v", evs[0])
+	}
+}
+
+func TestRegistrationWithoutSASL(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{})
+	srv.Caps["sasl"] = "PLAIN"
+
+	srv.Register()
+	// The session doesn't authenticate, so it doesn't know its host.
+	srv.Expect("WHO senpai")
+	srv.Sync()
+	if s.Nick() != "senpai" {
+		t.Errorf("expected to be registered as %q, got %q", "senpai", s.Nick())
+	}
+}
+
+// TestSessionConcurrentReads checks, when run with -race, that the state of a
+// session can be read while it processes messages from the server.
+func TestSessionConcurrentReads(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{Debug: true})
+
+	// Consume events.
+	polled := make(chan struct{})
+	go func() {
+		for range s.Poll() {
+		}
+		close(polled)
+	}()
+
+	// Hammer the session with reads.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Names("#senpai")
+				s.Typings("#senpai")
+				s.ChannelsSharedWith("alice")
+				s.Topic("#senpai")
+				s.Nick()
+				s.NickCf()
+				s.HasCapability("message-tags")
+				s.MaxContentLen("#senpai")
+			}
+		}()
+	}
+
+	srv.Join("#senpai", "a topic", "senpai", "@alice")
+	var script []string
+	for i := 0; i < 100; i++ {
+		script = append(script,
+			":bob!b@host JOIN #senpai",
+			"@+typing=active :bob!b@host TAGMSG #senpai",
+			":bob!b@host PRIVMSG #senpai :hello",
+			":bob!b@host NICK bobby",
+			fmt.Sprintf(":alice!a@host TOPIC #senpai :topic %d", i),
+			":bobby!b@host PART #senpai",
+			":carol!c@host JOIN #senpai",
+			":carol!c@host QUIT :bye",
+		)
+	}
+	srv.Send(script...)
+	srv.Sync()
+
+	close(stop)
+	wg.Wait()
+
+	assertNames(t, s, "#senpai", "@alice senpai")
+	if topic, _, _ := s.Topic("#senpai"); topic != "topic 99" {
+		t.Errorf("expected topic to be %q, got %q", "topic 99", topic)
+	}
+	if channels := s.ChannelsSharedWith("bobby"); len(channels) != 0 {
+		t.Errorf("expected no channel to be shared with bobby, got %q", channels)
+	}
+
+	s.Stop()
+	<-polled
+}
+
+// TestSessionSlowConsumer checks that the session keeps answering PINGs when
+// nobody receives its events.
+func TestSessionSlowConsumer(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{Debug: true})
+
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf(":bob!b@host PRIVMSG senpai :message #%d", i))
+	}
+	srv.Send(lines...)
+	srv.Sync()
+
+	if n := len(events(s)); n < 1000 {
+		t.Errorf("expected at least 1000 events, got %d", n)
+	}
+}
+
+func TestSessionQuit(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{})
+
+	quit := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		s.Quit("bye")
+		quit <- time.Since(start)
+	}()
+	srv.Expect("QUIT bye")
+	srv.Send("ERROR :Closing link (Quit: bye)")
+	srv.Close()
+
+	// Otherwise, Quit waits 2 seconds for the server to close the connection.
+	if d := <-quit; time.Second <= d {
+		t.Errorf("expected Quit to return once the server closed the connection, took %s", d)
+	}
+	for _, ev := range events(s) {
+		if err, ok := ev.(error); ok {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	srv, client := irctest.NewServer(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := irc.NewSessionContext(ctx, client, irc.SessionParams{
+		Nickname: "senpai",
+	})
+	if err != nil {
+		t.Fatalf("failed to create the session: %v", err)
+	}
+
+	cancel()
+	polled := make(chan struct{})
+	go func() {
+		for range s.Poll() {
+		}
+		close(polled)
+	}()
+	select {
+	case <-polled:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the session to stop when its context is cancelled")
+	}
+	if s.Running() {
+		t.Errorf("expected the session not to be running")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	var order []string
+	trace := func(name string) irc.Middleware {
+		return func(next irc.MessageHandler) irc.MessageHandler {
+			return func(msg irc.Message) error {
+				if msg.Command == "PRIVMSG" {
+					order = append(order, name)
+				}
+				return next(msg)
+			}
+		}
+	}
+	ignore := func(next irc.MessageHandler) irc.MessageHandler {
+		return func(msg irc.Message) error {
+			if msg.Prefix != nil && msg.Prefix.Name == "spammer" {
+				return nil
+			}
+			return next(msg)
+		}
+	}
+
+	srv, s := newRegisteredSession(t, irc.SessionParams{
+		Middlewares: []irc.Middleware{trace("first"), ignore, trace("second")},
+	})
+	srv.Send(
+		":spammer!s@host PRIVMSG senpai :buy now",
+		":alice!a@host PRIVMSG senpai :hello",
+		":alice!a@host PRIVMSG senpai :bye",
+	)
+
+	var registered bool
+	var contents []string
+	var others int
+	s.Dispatch(&irc.Handlers{
+		Registered: func(s *irc.Session, ev irc.RegisteredEvent) {
+			registered = true
+		},
+		Message: func(s *irc.Session, ev irc.MessageEvent) {
+			contents = append(contents, ev.Content)
+			if ev.Content == "bye" {
+				s.Stop()
+			}
+		},
+		Default: func(s *irc.Session, ev irc.Event) {
+			others++
+		},
+	})
+
+	if !registered {
+		t.Errorf("expected RegisteredEvent to be handled")
+	}
+	if len(contents) != 2 || contents[0] != "hello" || contents[1] != "bye" {
+		t.Errorf("expected messages [hello bye], got %q", contents)
+	}
+	if others != 0 {
+		t.Errorf("expected no unhandled events, got %d", others)
+	}
+	expectedOrder := []string{"first", "first", "second", "first", "second"}
+	if len(order) != len(expectedOrder) {
+		t.Fatalf("expected middleware calls %q, got %q", expectedOrder, order)
+	}
+	for i := range order {
+		if order[i] != expectedOrder[i] {
+			t.Errorf("expected middleware calls %q, got %q", expectedOrder, order)
+			break
+		}
+	}
+}
+
+func TestClosedByServer(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{})
+	srv.Send("ERROR :Closing link (K-lined)")
+	srv.Close()
+
+	// The session stops by itself, after handling the lines it has read.
+	var last irc.Event
+	for ev := range s.Poll() {
+		last = ev
+	}
+	if err, ok := last.(error); !ok || !strings.Contains(err.Error(), "K-lined") {
+		t.Errorf("expected the last event to be the server's ERROR, got %#v", last)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{})
+
+	s.Join("#senpai", "")
+	srv.Expect("JOIN #senpai")
+	srv.Join("#senpai", "welcome", "senpai", "@alice", "+bob", "carol")
+	srv.Sync()
+	assertNames(t, s, "#senpai", "+bob @alice carol senpai")
+	if topic, _, _ := s.Topic("#senpai"); topic != "welcome" {
+		t.Errorf("expected the topic to be %q, got %q", "welcome", topic)
+	}
+
+	srv.Send(
+		":dave!d@host JOIN #senpai",
+		":alice!a@host NICK alicia",
+		":bob!b@host PART #senpai :bye",
+		":alicia!a@host KICK #senpai carol :out",
+	)
+	srv.Sync()
+	assertNames(t, s, "#senpai", "@alicia dave senpai")
+	if shared := s.ChannelsSharedWith("alice"); len(shared) != 0 {
+		t.Errorf("expected alice to be unknown, got %q", shared)
+	}
+	if shared := s.ChannelsSharedWith("alicia"); len(shared) != 1 || shared[0] != "#senpai" {
+		t.Errorf("expected alicia to share #senpai, got %q", shared)
+	}
+
+	srv.Send(
+		":senpai!senpai@host NICK senpai2",
+		":alicia!a@host KICK #senpai senpai2 :out",
+	)
+	srv.Sync()
+	if s.Nick() != "senpai2" {
+		t.Errorf("expected nick to be %q, got %q", "senpai2", s.Nick())
+	}
+	assertNames(t, s, "#senpai", "")
+	if shared := s.ChannelsSharedWith("dave"); len(shared) != 0 {
+		t.Errorf("expected dave to be forgotten, got %q", shared)
+	}
+
+	var kinds []string
+	for _, ev := range events(s) {
+		switch ev := ev.(type) {
+		case irc.SelfJoinEvent:
+			kinds = append(kinds, "selfjoin "+ev.Channel)
+		case irc.UserJoinEvent:
+			kinds = append(kinds, "join "+ev.User.Name)
+		case irc.UserNickEvent:
+			kinds = append(kinds, "nick "+ev.FormerNick+" "+ev.User.Name)
+		case irc.UserPartEvent:
+			kinds = append(kinds, "part "+ev.User.Name)
+		case irc.SelfNickEvent:
+			kinds = append(kinds, "selfnick "+ev.FormerNick)
+		case irc.SelfPartEvent:
+			kinds = append(kinds, "selfpart "+ev.Channel)
+		}
+	}
+	expected := "selfjoin #senpai, join dave, nick alice alicia, part bob, part carol, selfnick senpai, selfpart #senpai"
+	if actual := strings.Join(kinds, ", "); actual != expected {
+		t.Errorf("expected events:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{}, "batch", "draft/chathistory", "server-time")
+	srv.Join("#senpai", "", "senpai", "alice")
+	srv.Sync()
+
+	s.RequestHistory("#senpai", time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	req := srv.ExpectCommand("CHATHISTORY")
+	if strings.Join(req.Params, " ") != "BEFORE #senpai timestamp=2020-01-01T12:00:01.000Z 100" {
+		t.Errorf("unexpected history request %q", req.String())
+	}
+	srv.SendHistory("#senpai",
+		"@time=2020-01-01T11:00:00.000Z :alice!a@host PRIVMSG #senpai :hello",
+		":alice!a@host JOIN #senpai",
+		"@time=2020-01-01T11:30:00.000Z :bob!b@host NOTICE #senpai :hi",
+	)
+	srv.Sync()
+	// The history doesn't change the state of the session.
+	assertNames(t, s, "#senpai", "alice senpai")
+
+	var history []irc.HistoryEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.HistoryEvent); ok {
+			history = append(history, ev)
+		}
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected a single HistoryEvent, got %d", len(history))
+	}
+	if history[0].Target != "#senpai" || len(history[0].Messages) != 2 {
+		t.Fatalf("unexpected HistoryEvent %#v", history[0])
+	}
+
+	first := history[0].Messages[0].(irc.MessageEvent)
+	if first.Content != "hello" || first.User.Name != "alice" || !first.TargetIsChannel {
+		t.Errorf("unexpected first message %#v", first)
+	}
+	if !first.Time.Equal(time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the first message to be dated from the server, got %s", first.Time)
+	}
+	second := history[0].Messages[1].(irc.MessageEvent)
+	if second.Content != "hi" || second.Command != "NOTICE" {
+		t.Errorf("unexpected second message %#v", second)
+	}
+}
+
+func TestServerPassword(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{
+		Password: "bouncer secret",
+		Debug:    true,
+	})
+
+	srv.Register()
+	if srv.Password != "bouncer secret" {
+		t.Errorf("expected the server password to be %q, got %q", "bouncer secret", srv.Password)
+	}
+	assertNoSecret(t, events(s), "bouncer secret", "PASS :********")
+}
+
+// assertNoSecret checks that the debug events don't contain secret, and that
+// the outgoing line which did contains hidden instead.
+func assertNoSecret(t *testing.T, evs []irc.Event, secret, hidden string) {
+	t.Helper()
+	found := false
+	for _, ev := range evs {
+		ev, ok := ev.(irc.RawMessageEvent)
+		if !ok {
+			continue
+		}
+		if strings.Contains(ev.Message, secret) {
+			t.Errorf("expected the secret to be hidden, got %q", ev.Message)
+		}
+		if ev.Outgoing && strings.Contains(ev.Message, hidden) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an outgoing line containing %q", hidden)
+	}
+}
+
+func TestNickServFallback(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{
+		Username:         "account",
+		Auth:             &irc.SASLPlain{Username: "account", Password: "hunter2"},
+		NickServPassword: "hunter2",
+		Debug:            true,
+	})
+	srv.Caps["echo-message"] = ""
+
+	// Without sasl in CAP LS, the session registers without authenticating.
+	srv.Register()
+	srv.Expect("WHO senpai")
+	srv.Expect("PRIVMSG NickServ :IDENTIFY account hunter2")
+	srv.Send(":senpai!senpai@irctest.localhost PRIVMSG NickServ :IDENTIFY account hunter2")
+	srv.Sync()
+
+	evs := events(s)
+	for _, ev := range evs {
+		if ev, ok := ev.(irc.MessageEvent); ok {
+			t.Errorf("expected the echoed IDENTIFY not to be shown, got %#v", ev)
+		}
+	}
+	assertNoSecret(t, evs, "hunter2", "IDENTIFY account ********")
+}
+
+func TestNickServUnneeded(t *testing.T) {
+	srv, _ := newSession(t, irc.SessionParams{
+		Username:         "account",
+		Auth:             &irc.SASLPlain{Username: "account", Password: "hunter2"},
+		NickServPassword: "hunter2",
+	})
+	srv.Caps["sasl"] = "PLAIN"
+	srv.Accounts["account"] = "hunter2"
+
+	// Logged in with SASL, the session doesn't talk to NickServ.
+	srv.Register()
+	srv.Send("PING :end")
+	srv.Expect("PONG :end")
+}
+
+func TestSASLPreference(t *testing.T) {
+	srv, _ := newSession(t, irc.SessionParams{
+		Auths: []irc.SASLClient{
+			&irc.SASLExternal{},
+			&irc.SASLPlain{Username: "senpai", Password: "hunter2"},
+		},
+	})
+	srv.Caps["sasl"] = "PLAIN"
+	srv.Accounts["senpai"] = "hunter2"
+	srv.ExternalAccount = "senpai"
+
+	// EXTERNAL is not advertised, so the session goes straight to PLAIN.
+	// Logged in, it knows its host and doesn't send WHO.
+	srv.Register()
+	srv.Send("PING :end")
+	srv.Expect("PONG :end")
+}
+
+func TestSASLFallback(t *testing.T) {
+	srv, _ := newSession(t, irc.SessionParams{
+		Auths: []irc.SASLClient{
+			&irc.SASLExternal{},
+			&irc.SASLPlain{Username: "senpai", Password: "hunter2"},
+		},
+	})
+	srv.Caps["sasl"] = ""
+	srv.Accounts["senpai"] = "hunter2"
+
+	srv.Expect("CAP LS 302")
+	srv.ExpectCommand("NICK")
+	srv.ExpectCommand("USER")
+	srv.Send(":irctest CAP * LS :sasl")
+	srv.Expect("CAP REQ sasl")
+	srv.Send(":irctest CAP * ACK sasl")
+
+	// EXTERNAL fails, and the server lists the mechanisms it supports.
+	srv.Expect("AUTHENTICATE EXTERNAL")
+	srv.Send("AUTHENTICATE +")
+	srv.Expect("AUTHENTICATE +")
+	srv.Send(
+		":irctest 908 senpai PLAIN :are available SASL mechanisms",
+		":irctest 904 senpai :SASL authentication failed",
+	)
+
+	srv.Expect("AUTHENTICATE PLAIN")
+	srv.Send("AUTHENTICATE +")
+	srv.ExpectCommand("AUTHENTICATE")
+	srv.Send(
+		":irctest 900 senpai senpai!senpai@host senpai :You are now logged in as senpai",
+		":irctest 903 senpai :SASL authentication successful",
+	)
+	srv.Expect("CAP END")
+}
+
+func TestSASLCapNew(t *testing.T) {
+	srv, _ := newSession(t, irc.SessionParams{
+		Auth: &irc.SASLPlain{Username: "senpai", Password: "hunter2"},
+	})
+	srv.Accounts["senpai"] = "hunter2"
+
+	srv.Register()
+	srv.Expect("WHO senpai")
+
+	// The bouncer has reconnected to a network that supports SASL.
+	srv.Caps["sasl"] = "PLAIN"
+	srv.Send(":irctest CAP senpai NEW :sasl=PLAIN")
+	srv.Expect("CAP REQ sasl")
+	srv.Send(":irctest CAP senpai ACK :sasl")
+	srv.Authenticate()
+
+	// Negotiation is over since registration, no CAP END is sent.
+	srv.Send("PING :end")
+	srv.Expect("PONG :end")
+}
+
+func TestSTSUpgrade(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{})
+
+	srv.Expect("CAP LS 302")
+	srv.ExpectCommand("NICK")
+	srv.ExpectCommand("USER")
+	srv.Send(":irctest CAP * LS :sasl sts=port=6697,duration=300")
+	srv.ExpectClosed()
+
+	evs := events(s)
+	if len(evs) != 1 {
+		t.Fatalf("expected a single event, got %#v", evs)
+	}
+	if ev, ok := evs[0].(irc.STSUpgradeEvent); !ok || ev.Port != 6697 {
+		t.Errorf("expected an upgrade to port 6697, got %#v", evs[0])
+	}
+}
+
+func TestSTSPolicy(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{Secure: true})
+	srv.Caps["sts"] = "duration=86400,preload"
+
+	// The policy doesn't prevent registration, and sts is not requested.
+	if enabled := srv.Register(); len(enabled) != 0 {
+		t.Errorf("expected no capability to be requested, got %q", enabled)
+	}
+	srv.Expect("WHO senpai")
+
+	var policies []irc.STSPolicyEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.STSPolicyEvent); ok {
+			policies = append(policies, ev)
+		}
+	}
+	if len(policies) != 1 || policies[0].Duration != 24*time.Hour || !policies[0].Preload {
+		t.Errorf("expected a policy of 24 hours with preload, got %#v", policies)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{}, "batch", "draft/multiline=max-bytes=4096", "message-tags")
+	srv.Join("#senpai", "", "senpai", "alice")
+	srv.Send(
+		"@msgid=abc :alice!a@host PRIVMSG #senpai :hello",
+		"@msgid=def;+draft/reply=abc BATCH +ml draft/multiline #senpai",
+		"@batch=ml :senpai!s@host PRIVMSG #senpai :hi",
+		"@batch=ml :senpai!s@host PRIVMSG #senpai :alice",
+		"BATCH -ml",
+	)
+	srv.Sync()
+
+	s.Reply("#senpai", "abc", "how are you?")
+	srv.Expect("@+draft/reply=abc PRIVMSG #senpai :how are you?")
+	s.Reply("#senpai", "abc", "line 1\nline 2")
+	srv.Expect("@+draft/reply=abc BATCH +senpai1 draft/multiline #senpai")
+	srv.Expect("@batch=senpai1 PRIVMSG #senpai :line 1")
+	srv.Expect("@batch=senpai1 PRIVMSG #senpai :line 2")
+	srv.Expect("BATCH -senpai1")
+
+	var msgs []irc.MessageEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.MessageEvent); ok {
+			msgs = append(msgs, ev)
+		}
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %#v", msgs)
+	}
+	if msgs[0].ID != "abc" || msgs[0].ReplyTo != "" {
+		t.Errorf("unexpected first message %#v", msgs[0])
+	}
+	if msgs[1].ID != "def" || msgs[1].ReplyTo != "abc" || msgs[1].Content != "hi\nalice" {
+		t.Errorf("expected the multiline message to reply to the first one, got %#v", msgs[1])
+	}
+}
+
+func TestRepliesWithoutMessageTags(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{})
+
+	s.Reply("#senpai", "abc", "how are you?")
+	srv.Expect("PRIVMSG #senpai :how are you?")
+	s.Stop()
+}
+
+func TestReactions(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{}, "batch", "draft/chathistory", "echo-message", "message-tags")
+	srv.Join("#senpai", "", "senpai", "alice")
+
+	s.React("#senpai", "abc", "\U0001F44D")
+	srv.Expect("@+draft/react=\U0001F44D;+draft/reply=abc TAGMSG #senpai")
+	srv.Send(
+		"@+draft/react=\U0001F44D;+draft/reply=abc :senpai!s@host TAGMSG #senpai",
+		"@+draft/react=\U0001F389;+draft/reply=abc;+typing=done :alice!a@host TAGMSG #senpai",
+		"@+draft/react=\U0001F389 :alice!a@host TAGMSG #senpai",
+	)
+	srv.SendHistory("#senpai",
+		"@msgid=abc :alice!a@host PRIVMSG #senpai :hello",
+		"@+draft/react=\U0001F44D;+draft/reply=abc :bob!b@host TAGMSG #senpai",
+	)
+	srv.Sync()
+
+	var reactions []irc.ReactionEvent
+	var history []irc.HistoryEvent
+	for _, ev := range events(s) {
+		switch ev := ev.(type) {
+		case irc.ReactionEvent:
+			reactions = append(reactions, ev)
+		case irc.HistoryEvent:
+			history = append(history, ev)
+		}
+	}
+	if len(reactions) != 2 {
+		t.Fatalf("expected 2 reactions, got %#v", reactions)
+	}
+	if r := reactions[0]; r.User.Name != "senpai" || r.MsgID != "abc" || r.Reaction != "\U0001F44D" || !r.TargetIsChannel {
+		t.Errorf("unexpected echoed reaction %#v", r)
+	}
+	if r := reactions[1]; r.User.Name != "alice" || r.Reaction != "\U0001F389" {
+		t.Errorf("unexpected reaction %#v", r)
+	}
+	if len(history) != 1 || len(history[0].Messages) != 2 {
+		t.Fatalf("expected the history to contain a message and a reaction, got %#v", history)
+	}
+	if r, ok := history[0].Messages[1].(irc.ReactionEvent); !ok || r.User.Name != "bob" {
+		t.Errorf("unexpected reaction in history %#v", history[0].Messages[1])
+	}
+}
+
+func TestRedact(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{}, "batch", "draft/chathistory", "draft/message-redaction")
+	srv.Join("#senpai", "", "senpai", "alice")
+
+	s.Redact("#senpai", "abc", "")
+	srv.Expect("REDACT #senpai abc")
+	s.Redact("#senpai", "def", "oops")
+	srv.Expect("REDACT #senpai def oops")
+	srv.Send(
+		":senpai!s@host REDACT #senpai abc",
+		":alice!a@host REDACT #SENPAI ghi :wrong channel",
+		":alice!a@host REDACT senpai jkl",
+	)
+	srv.SendHistory("#senpai",
+		"@msgid=mno :alice!a@host PRIVMSG #senpai :hello",
+		":alice!a@host REDACT #senpai mno",
+	)
+	srv.Sync()
+
+	var redactions []irc.RedactEvent
+	var history []irc.HistoryEvent
+	for _, ev := range events(s) {
+		switch ev := ev.(type) {
+		case irc.RedactEvent:
+			redactions = append(redactions, ev)
+		case irc.HistoryEvent:
+			history = append(history, ev)
+		}
+	}
+	if len(redactions) != 3 {
+		t.Fatalf("expected 3 redactions, got %#v", redactions)
+	}
+	if r := redactions[0]; r.User.Name != "senpai" || r.MsgID != "abc" || r.Target != "#senpai" || !r.TargetIsChannel {
+		t.Errorf("unexpected echoed redaction %#v", r)
+	}
+	if r := redactions[1]; r.Target != "#senpai" || r.MsgID != "ghi" || r.Reason != "wrong channel" {
+		t.Errorf("unexpected redaction %#v", r)
+	}
+	if r := redactions[2]; r.TargetIsChannel || r.MsgID != "jkl" {
+		t.Errorf("unexpected redaction in a query %#v", r)
+	}
+	if len(history) != 1 || len(history[0].Messages) != 2 {
+		t.Fatalf("expected the history to contain a message and a redaction, got %#v", history)
+	}
+	if r, ok := history[0].Messages[1].(irc.RedactEvent); !ok || r.MsgID != "mno" {
+		t.Errorf("unexpected redaction in history %#v", history[0].Messages[1])
+	}
+}
+
+func TestReadMarker(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{}, "draft/read-marker")
+	srv.Join("#senpai", "", "senpai", "alice")
+	srv.Expect("MARKREAD #senpai")
+	srv.Send(":irctest MARKREAD #SENPAI timestamp=2020-01-01T12:00:00.000Z")
+	srv.Sync()
+
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if marker := s.ReadMarker("#senpai"); !marker.Equal(at) {
+		t.Errorf("expected the read marker to be at %s, got %s", at, marker)
+	}
+
+	// Older markers are not sent.
+	s.SetReadMarker("#senpai", at.Add(-time.Minute))
+	s.SetReadMarker("#senpai", at.Add(time.Minute))
+	srv.Expect("MARKREAD #senpai timestamp=2020-01-01T12:01:00.000Z")
+
+	// Markers that go backwards are ignored.
+	srv.Send(":irctest MARKREAD #senpai timestamp=2020-01-01T11:00:00.000Z")
+	srv.Sync()
+
+	var markers []irc.ReadMarkerEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.ReadMarkerEvent); ok {
+			markers = append(markers, ev)
+		}
+	}
+	if len(markers) != 1 || markers[0].Target != "#senpai" || !markers[0].Time.Equal(at) {
+		t.Errorf("expected a single read marker for #senpai, got %#v", markers)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{})
+	srv.ISupport = []string{"MONITOR=100"}
+	s.Monitor("alice", "bob", "Alice")
+
+	srv.Register()
+	srv.Expect("WHO senpai")
+	srv.Reply("376", "End of /MOTD command.")
+	srv.Expect("MONITOR + alice,bob")
+	srv.Reply("730", "alice!a@host")
+	srv.Reply("731", "bob")
+	srv.Sync()
+
+	contacts := s.Contacts()
+	if len(contacts) != 2 || !contacts[0].Online || contacts[1].Online {
+		t.Errorf("expected alice to be online and bob offline, got %#v", contacts)
+	}
+
+	s.Unmonitor("BOB", "carol")
+	srv.Expect("MONITOR - BOB")
+	srv.Reply("731", "bob")
+	srv.Sync()
+
+	var presences []irc.PresenceEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.PresenceEvent); ok {
+			presences = append(presences, ev)
+		}
+	}
+	if len(presences) != 2 {
+		t.Fatalf("expected 2 presence events, got %#v", presences)
+	}
+	if p := presences[0]; p.User.Name != "alice" || p.User.Host != "host" || !p.Online {
+		t.Errorf("unexpected presence %#v", p)
+	}
+	if p := presences[1]; p.User.Name != "bob" || p.Online {
+		t.Errorf("unexpected presence %#v", p)
+	}
+}
+
+func TestMonitorLimit(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{})
+	srv.ISupport = []string{"MONITOR=2"}
+	s.Monitor("alice", "bob", "carol")
+
+	srv.Register()
+	srv.Expect("WHO senpai")
+	srv.Reply("376", "End of /MOTD command.")
+	srv.Expect("MONITOR + alice,bob")
+
+	// Removing alice makes room for carol.
+	s.Unmonitor("alice")
+	srv.Expect("MONITOR - alice")
+	srv.Expect("MONITOR + carol")
+
+	// The server rejects carol anyway, she is sent again once there is room.
+	srv.Reply("734", "2", "carol", "Monitor list is full.")
+	srv.Sync()
+	s.Unmonitor("bob")
+	srv.Expect("MONITOR - bob")
+	srv.Expect("MONITOR + carol")
+
+	var errs []string
+	for _, ev := range events(s) {
+		if err, ok := ev.(error); ok {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0], "carol") || !strings.Contains(errs[1], "carol") {
+		t.Errorf("expected errors about carol not being monitored, got %q", errs)
+	}
+}
+
+func TestMonitorWatch(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{})
+	srv.ISupport = []string{"WATCH=128"}
+
+	srv.Register()
+	srv.Expect("WHO senpai")
+	srv.Reply("422", "MOTD File is missing")
+	srv.Sync()
+
+	s.Monitor("alice", "bob")
+	srv.Expect("WATCH +alice +bob")
+	srv.Reply("604", "alice", "a", "host", "0", "is online")
+	srv.Reply("605", "bob", "*", "*", "0", "is offline")
+	srv.Reply("601", "alice", "a", "host", "0", "logged offline")
+	srv.Sync()
+
+	var online []bool
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.PresenceEvent); ok {
+			online = append(online, ev.Online)
+		}
+	}
+	if len(online) != 3 || !online[0] || online[1] || online[2] {
+		t.Errorf("expected alice to come online then go offline, got %v", online)
+	}
+}
+
+func TestSetNameChangeHost(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{RealName: "Senpai"}, "chghost", "extended-join", "setname")
+	srv.Join("#senpai", "", "senpai")
+	srv.Send(
+		":alice!a@host JOIN #senpai * :Alice",
+		":alice!a@host SETNAME :Alice Liddell",
+		":alice!a@host CHGHOST alice wonderland",
+	)
+
+	s.SetName("Senpai-kun")
+	srv.Expect("SETNAME :Senpai-kun")
+	srv.Send(":senpai!senpai@irctest.localhost SETNAME :Senpai-kun")
+	srv.Sync()
+
+	if s.RealName() != "Senpai-kun" {
+		t.Errorf("expected the real name to be updated, got %q", s.RealName())
+	}
+	for _, m := range s.Names("#senpai") {
+		if m.Name.Name != "alice" {
+			continue
+		}
+		if m.Name.User != "alice" || m.Name.Host != "wonderland" || m.RealName != "Alice Liddell" {
+			t.Errorf("expected alice to be updated, got %#v and %q", m.Name, m.RealName)
+		}
+	}
+
+	var names []irc.SetNameEvent
+	var hosts []irc.ChangeHostEvent
+	for _, ev := range events(s) {
+		switch ev := ev.(type) {
+		case irc.SetNameEvent:
+			names = append(names, ev)
+		case irc.ChangeHostEvent:
+			hosts = append(hosts, ev)
+		}
+	}
+	if len(names) != 2 || names[0].RealName != "Alice Liddell" || names[1].User.Name != "senpai" {
+		t.Errorf("unexpected real name changes %#v", names)
+	}
+	if len(hosts) != 1 || hosts[0].FormerUser != "a" || hosts[0].FormerHost != "host" || hosts[0].User.Host != "wonderland" {
+		t.Errorf("unexpected host changes %#v", hosts)
+	}
+}
+
+func TestChannelRename(t *testing.T) {
+	srv, s := newRegisteredSession(t, irc.SessionParams{}, "draft/channel-rename")
+	srv.Join("#senpai", "hello", "senpai", "alice")
+	srv.Send(":alice!a@host RENAME #SENPAI #senpai-dev :Moving on")
+	srv.Sync()
+
+	assertNames(t, s, "#senpai", "")
+	assertNames(t, s, "#senpai-dev", "alice senpai")
+	if topic, _, _ := s.Topic("#senpai-dev"); topic != "hello" {
+		t.Errorf("expected the channel to keep its topic, got %q", topic)
+	}
+
+	var renames []irc.ChannelRenameEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.ChannelRenameEvent); ok {
+			renames = append(renames, ev)
+		}
+	}
+	if len(renames) != 1 {
+		t.Fatalf("expected a single rename, got %#v", renames)
+	}
+	if r := renames[0]; r.FormerName != "#senpai" || r.Name != "#senpai-dev" || r.Reason != "Moving on" {
+		t.Errorf("unexpected rename %#v", r)
+	}
+}
+
+func TestBouncerNetworks(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{})
+	srv.Caps["batch"] = ""
+	srv.Caps["soju.im/bouncer-networks"] = ""
+
+	srv.Register()
+	if srv.NetID != "" {
+		t.Errorf("expected the session not to bind to a network, got %q", srv.NetID)
+	}
+	srv.Expect("WHO senpai")
+	srv.Expect("BOUNCER LISTNETWORKS")
+	srv.Send(
+		":irctest BATCH +nets soju.im/bouncer-networks",
+		"@batch=nets :irctest BOUNCER NETWORK 1 name=libera;host=irc.libera.chat;state=connected",
+		"@batch=nets :irctest BOUNCER NETWORK 2 name=OFTC\\sbis;state=disconnected",
+		":irctest BATCH -nets",
+	)
+
+	s.AddNetwork(map[string]string{"name": "rizon", "host": "irc.rizon.net"})
+	srv.Expect("BOUNCER ADDNETWORK host=irc.rizon.net;name=rizon")
+	srv.Send(":irctest BOUNCER ADDNETWORK 3")
+	// Without soju.im/bouncer-networks-notify, networks are listed again.
+	srv.Expect("BOUNCER LISTNETWORKS")
+
+	s.ChangeNetwork("2", map[string]string{"nick": "senpai_"})
+	srv.Expect("BOUNCER CHANGENETWORK 2 nick=senpai_")
+	srv.Send(":irctest BOUNCER NETWORK 2 *")
+	srv.Sync()
+
+	var networks []irc.BouncerNetworkEvent
+	for _, ev := range events(s) {
+		if ev, ok := ev.(irc.BouncerNetworkEvent); ok {
+			networks = append(networks, ev)
+		}
+	}
+	if len(networks) != 3 {
+		t.Fatalf("expected 3 network events, got %#v", networks)
+	}
+	if n := networks[0]; n.ID != "1" || n.Attrs["name"] != "libera" || n.Attrs["state"] != "connected" || n.Deleted {
+		t.Errorf("unexpected network %#v", n)
+	}
+	if n := networks[1]; n.ID != "2" || n.Attrs["name"] != "OFTC bis" {
+		t.Errorf("expected escaped attributes to be decoded, got %#v", n)
+	}
+	if n := networks[2]; n.ID != "2" || !n.Deleted {
+		t.Errorf("expected network 2 to be deleted, got %#v", n)
+	}
+}
+
+func TestBouncerBind(t *testing.T) {
+	srv, s := newSession(t, irc.SessionParams{NetID: "42"})
+	srv.Caps["soju.im/bouncer-networks"] = ""
+
+	srv.Register()
+	if srv.NetID != "42" {
+		t.Errorf("expected the session to bind to network 42, got %q", srv.NetID)
+	}
+	// Bound sessions don't list the networks.
+	srv.Expect("WHO senpai")
+	s.SendRaw("PING senpai")
+	srv.Expect("PING senpai")
+}
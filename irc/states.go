@@ -3,12 +3,15 @@ package irc
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -42,23 +45,49 @@ func (auth *SASLPlain) Respond(challenge string) (res string, err error) {
 	return
 }
 
+// SASLExternal logs in with credentials established outside of IRC, such as a
+// TLS client certificate.
+type SASLExternal struct{}
+
+func (auth *SASLExternal) Handshake() (mech string) {
+	mech = "EXTERNAL"
+	return
+}
+
+func (auth *SASLExternal) Respond(challenge string) (res string, err error) {
+	if challenge != "+" {
+		err = errors.New("unexpected challenge")
+		return
+	}
+
+	res = "+"
+	return
+}
+
 var SupportedCapabilities = map[string]struct{}{
-	"account-notify":    {},
-	"account-tag":       {},
-	"away-notify":       {},
-	"batch":             {},
-	"cap-notify":        {},
-	"draft/chathistory": {},
-	"echo-message":      {},
-	"extended-join":     {},
-	"invite-notify":     {},
-	"labeled-response":  {},
-	"message-tags":      {},
-	"multi-prefix":      {},
-	"server-time":       {},
-	"sasl":              {},
-	"setname":           {},
-	"userhost-in-names": {},
+	"account-notify":                  {},
+	"account-tag":                     {},
+	"away-notify":                     {},
+	"batch":                           {},
+	"cap-notify":                      {},
+	"chghost":                         {},
+	"draft/channel-rename":            {},
+	"draft/chathistory":               {},
+	"draft/message-redaction":         {},
+	"draft/multiline":                 {},
+	"draft/read-marker":               {},
+	"echo-message":                    {},
+	"extended-join":                   {},
+	"invite-notify":                   {},
+	"labeled-response":                {},
+	"message-tags":                    {},
+	"multi-prefix":                    {},
+	"server-time":                     {},
+	"sasl":                            {},
+	"setname":                         {},
+	"soju.im/bouncer-networks":        {},
+	"soju.im/bouncer-networks-notify": {},
+	"userhost-in-names":               {},
 }
 
 const (
@@ -77,6 +106,7 @@ type (
 
 	actionJoin struct {
 		Channel string
+		Key     string
 	}
 	actionPart struct {
 		Channel string
@@ -90,6 +120,7 @@ type (
 	actionPrivMsg struct {
 		Target  string
 		Content string
+		ReplyTo string
 	}
 
 	actionTyping struct {
@@ -99,15 +130,58 @@ type (
 		Channel string
 	}
 
+	actionReact struct {
+		Target   string
+		MsgID    string
+		Reaction string
+	}
+
+	actionSetName struct {
+		RealName string
+	}
+
+	actionAddNetwork struct {
+		Attrs map[string]string
+	}
+
+	actionChangeNetwork struct {
+		NetID string
+		Attrs map[string]string
+	}
+
+	actionMonitor struct {
+		Nicks []string
+		Add   bool
+	}
+
+	actionRedact struct {
+		Target string
+		MsgID  string
+		Reason string
+	}
+
+	actionReadMarker struct {
+		Target string
+		Time   time.Time
+	}
+
 	actionRequestHistory struct {
 		Target string
 		Before time.Time
 	}
+
+	actionQuit struct {
+		Reason string
+	}
 )
 
+// quitTimeout is how long Quit waits for the server to close the connection.
+const quitTimeout = 2 * time.Second
+
 type User struct {
-	Name    *Prefix
-	AwayMsg string
+	Name     *Prefix
+	AwayMsg  string
+	RealName string // empty if unknown
 }
 
 type Channel struct {
@@ -124,61 +198,165 @@ type SessionParams struct {
 	Username string
 	RealName string
 
-	Auth SASLClient
+	// Auth is the SASL client used to log in.  To try several mechanisms,
+	// list them in Auths instead, in order of preference: the session uses
+	// the first one the server supports, and falls back to the next ones if
+	// it fails.  Auth, if set, comes first.
+	Auth  SASLClient
+	Auths []SASLClient
+
+	// Password is the server password, sent with PASS before registering.
+	// Bouncers often require one.
+	Password string
+
+	// NickServPassword is used to identify to NickServ as Username, when the
+	// session is not logged in once registered, e.g. because the server
+	// doesn't support SASL.  Leave it empty to never talk to NickServ.
+	NickServPassword string
+
+	// SendBurst is the number of lines that can be sent at once, after which
+	// lines are sent at the rate of SendRate lines per second.  Defaults to
+	// 5 lines and 1 line per second.  Set SendRate to a negative value to
+	// disable flood protection.
+	SendBurst int
+	SendRate  float64
+
+	// PingInterval is the time between two PINGs sent to measure the lag.  If
+	// the server doesn't answer a PING within PingTimeout, the connection is
+	// considered dead and is closed.  Default to 30 and 60 seconds.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// Secure is whether conn is encrypted, e.g. with TLS.  On plaintext
+	// connections, sessions stop as soon as the server advertises an STS
+	// policy (IRCv3 sts capability) and emit STSUpgradeEvent, so that the
+	// client can reconnect securely.
+	Secure bool
+
+	// NetID is the ID of the network of the bouncer to bind the session to,
+	// during registration (soju.im/bouncer-networks extension).  If empty,
+	// the session is not bound and lists the networks of the bouncer instead.
+	NetID string
+
+	// Middlewares wrap the processing of each message received from the
+	// server.  The first one is the outermost.
+	Middlewares []Middleware
 
 	Debug bool
 }
 
 type Session struct {
-	conn io.ReadWriteCloser
-	msgs chan Message
-	acts chan action
-	evts chan Event
+	conn  io.ReadWriteCloser
+	out   *sendQueue
+	lines chan string
+	acts  chan action
+	evts  *eventQueue
+	done  chan struct{}
+	stop  sync.Once
 
-	debug bool
+	debug       bool
+	secure      bool
+	middlewares []Middleware
+
+	running atomic.Value // bool
+
+	// l protects the state of the session below, which is modified by the
+	// run goroutine and read by the exported methods.
+	l sync.RWMutex
 
-	running      atomic.Value // bool
 	registered   bool
+	quitting     bool
 	typings      *Typings
 	typingStamps map[string]time.Time
 
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	pingToken    string
+	pingSent     time.Time
+	pingDeadline <-chan time.Time
+
 	nick   string
 	nickCf string
 	user   string
 	real   string
 	acct   string
 	host   string
-	auth   SASLClient
+
+	auths     []SASLClient
+	auth      SASLClient          // the one in use
+	saslMechs []string            // advertised by the server, nil if unknown
+	saslTried map[string]struct{} // mechanisms that have been tried
+
+	nickServAcct string
+	nickServPass string
+	netID        string
 
 	availableCaps map[string]string
 	enabledCaps   map[string]struct{}
 	features      map[string]string
 
-	users     map[string]*User
-	channels  map[string]Channel
-	chBatches map[string]HistoryEvent
+	users    map[string]*User
+	channels map[string]Channel
+	batches  map[string]batch
+	batchID  int
+
+	// readMarkers are the times of the last read message of each target,
+	// known from the draft/read-marker extension.
+	readMarkers map[string]time.Time
+
+	// monitored are the nicknames whose presence is monitored, and online
+	// whether they are online, if known.  monitorReady is true once the
+	// server has been told about them, at the end of the registration.
+	// watched are those the server has been told about, which can be fewer
+	// because of the limit advertised in ISUPPORT.
+	monitored    map[string]string
+	online       map[string]bool
+	watched      map[string]struct{}
+	monitorReady bool
+}
+
+// batch is a BATCH that has been opened by the server but not closed yet.
+type batch struct {
+	// Outer is the reference tag of the enclosing batch, if any.
+	Outer string
+	Event BatchEvent
 }
 
 func NewSession(conn io.ReadWriteCloser, params SessionParams) (*Session, error) {
+	return NewSessionContext(context.Background(), conn, params)
+}
+
+// NewSessionContext is like NewSession, but the session is stopped when ctx is
+// done, whether it is still registering or not.
+func NewSessionContext(ctx context.Context, conn io.ReadWriteCloser, params SessionParams) (*Session, error) {
 	s := &Session{
 		conn:          conn,
-		msgs:          make(chan Message, 64),
+		lines:         make(chan string, 64),
 		acts:          make(chan action, 64),
-		evts:          make(chan Event, 64),
+		evts:          newEventQueue(),
+		done:          make(chan struct{}),
 		debug:         params.Debug,
+		secure:        params.Secure,
+		middlewares:   params.Middlewares,
 		typings:       NewTypings(),
 		typingStamps:  map[string]time.Time{},
 		nick:          params.Nickname,
 		nickCf:        CasemapASCII(params.Nickname),
 		user:          params.Username,
 		real:          params.RealName,
-		auth:          params.Auth,
+		saslTried:     map[string]struct{}{},
+		nickServPass:  params.NickServPassword,
+		netID:         params.NetID,
 		availableCaps: map[string]string{},
 		enabledCaps:   map[string]struct{}{},
 		features:      map[string]string{},
 		users:         map[string]*User{},
 		channels:      map[string]Channel{},
-		chBatches:     map[string]HistoryEvent{},
+		batches:       map[string]batch{},
+		readMarkers:   map[string]time.Time{},
+		monitored:     map[string]string{},
+		watched:       map[string]struct{}{},
+		online:        map[string]bool{},
 	}
 
 	if s.nick == "" {
@@ -187,13 +365,47 @@ func NewSession(conn io.ReadWriteCloser, params SessionParams) (*Session, error)
 	if s.user == "" {
 		s.user = s.nick
 	}
+	// Keep the account name apart from s.user, which CHGHOST can change.
+	s.nickServAcct = s.user
 	if s.real == "" {
 		s.real = s.nick
 	}
+	if params.Auth != nil {
+		s.auths = append(s.auths, params.Auth)
+	}
+	s.auths = append(s.auths, params.Auths...)
+
+	burst := params.SendBurst
+	if burst <= 0 {
+		burst = 5
+	}
+	rate := params.SendRate
+	if rate == 0 {
+		rate = 1
+	}
+	s.out = newSendQueue(conn, burst, rate)
+
+	s.pingInterval = params.PingInterval
+	if s.pingInterval <= 0 {
+		s.pingInterval = 30 * time.Second
+	}
+	s.pingTimeout = params.PingTimeout
+	if s.pingTimeout <= 0 {
+		s.pingTimeout = 60 * time.Second
+	}
 
 	s.running.Store(true)
 
-	err := s.send("CAP LS 302\r\nNICK %s\r\nUSER %s 0 * :%s\r\n", s.nick, s.user, s.real)
+	var msgs []Message
+	if params.Password != "" {
+		msgs = append(msgs, NewMessage("PASS", params.Password))
+	}
+	msgs = append(msgs,
+		NewMessage("CAP", "LS", "302"),
+		NewMessage("NICK", s.nick),
+		NewMessage("USER", s.user, "0", "*", s.real),
+	)
+	err := s.send(msgs...)
 	if err != nil {
 		return nil, err
 	}
@@ -201,22 +413,26 @@ func NewSession(conn io.ReadWriteCloser, params SessionParams) (*Session, error)
 	go func() {
 		r := bufio.NewScanner(conn)
 
+		// Close lines before stopping, so that run handles what is left in
+		// it (e.g. the server's ERROR) before returning.
+		defer s.Stop()
+		defer close(s.lines)
+
 		for r.Scan() {
-			line := r.Text()
-			msg, err := ParseMessage(line)
-			if err != nil {
-				continue
-			}
-			valid := msg.IsValid()
-			if s.debug {
-				s.evts <- RawMessageEvent{Message: line, IsValid: valid}
-			}
-			if valid {
-				s.msgs <- msg
+			select {
+			case s.lines <- r.Text():
+			case <-s.done:
+				return
 			}
 		}
+	}()
 
-		s.Stop()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.done:
+		}
 	}()
 
 	go s.run()
@@ -228,31 +444,72 @@ func (s *Session) Running() bool {
 	return s.running.Load().(bool)
 }
 
+// Stop closes the connection.  The channel returned by Poll is closed once the
+// session has stopped and all events have been delivered.
 func (s *Session) Stop() {
-	if !s.Running() {
-		return
+	s.stop.Do(func() {
+		s.running.Store(false)
+		close(s.done)
+		s.out.Close()
+		_ = s.conn.Close()
+	})
+}
+
+// Quit sends QUIT with the given reason, then stops the session once the
+// server has closed the connection, or after a short delay.
+func (s *Session) Quit(reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), quitTimeout)
+	defer cancel()
+	s.QuitContext(ctx, reason)
+}
+
+// QuitContext is like Quit, but waits for the server until ctx is done.
+func (s *Session) QuitContext(ctx context.Context, reason string) {
+	s.act(actionQuit{reason})
+	select {
+	case <-s.done:
+	case <-ctx.Done():
 	}
-	s.running.Store(false)
-	_ = s.conn.Close()
-	close(s.acts)
-	close(s.evts)
-	close(s.msgs)
+	s.Stop()
 }
 
+// Poll returns the channel of events.  Events are buffered for as long as they
+// are not received, so that the session never waits for its consumer.  The
+// channel must be drained until it is closed, unless Discard is called.
 func (s *Session) Poll() (events <-chan Event) {
-	return s.evts
+	return s.evts.Out()
+}
+
+// Discard stops the session, drops the events that have not been received and
+// closes the channel returned by Poll.  Call it instead of draining Poll when
+// the events of the session are not needed anymore.
+func (s *Session) Discard() {
+	s.Stop()
+	s.evts.Discard()
+}
+
+// Queued returns the number of lines that are waiting to be sent to the
+// server.
+func (s *Session) Queued() int {
+	return s.out.Len()
 }
 
 func (s *Session) HasCapability(capability string) bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
 	_, ok := s.enabledCaps[capability]
 	return ok
 }
 
 func (s *Session) Nick() string {
+	s.l.RLock()
+	defer s.l.RUnlock()
 	return s.nick
 }
 
 func (s *Session) NickCf() string {
+	s.l.RLock()
+	defer s.l.RUnlock()
 	return s.nickCf
 }
 
@@ -266,6 +523,9 @@ func (s *Session) Casemap(name string) string {
 }
 
 func (s *Session) Names(channel string) []Member {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
 	var names []Member
 	if c, ok := s.channels[s.Casemap(channel)]; ok {
 		names = make([]Member, 0, len(c.Members))
@@ -273,6 +533,7 @@ func (s *Session) Names(channel string) []Member {
 			names = append(names, Member{
 				PowerLevel: pl,
 				Name:       u.Name.Copy(),
+				RealName:   u.RealName,
 			})
 		}
 	}
@@ -280,17 +541,25 @@ func (s *Session) Names(channel string) []Member {
 }
 
 func (s *Session) Typings(target string) []string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	s.typings.l.Lock()
+	defer s.typings.l.Unlock()
+
 	targetCf := s.Casemap(target)
 	var res []string
 	for t := range s.typings.targets {
-		if targetCf == t.Target {
-			res = append(res, s.users[t.Name].Name.Name)
+		if u, ok := s.users[t.Name]; ok && targetCf == t.Target {
+			res = append(res, u.Name.Name)
 		}
 	}
 	return res
 }
 
 func (s *Session) ChannelsSharedWith(name string) []string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
 	var user *User
 	if u, ok := s.users[s.Casemap(name)]; ok {
 		user = u
@@ -307,64 +576,226 @@ func (s *Session) ChannelsSharedWith(name string) []string {
 }
 
 func (s *Session) Topic(channel string) (topic string, who *Prefix, at time.Time) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
 	channelCf := s.Casemap(channel)
 	if c, ok := s.channels[channelCf]; ok {
 		topic = c.Topic
-		who = c.TopicWho
+		who = c.TopicWho.Copy()
 		at = c.TopicTime
 	}
 	return
 }
 
+// MaxContentLen returns the maximum length, in bytes, of the content of a
+// PRIVMSG sent to target.  Past this length, the server would truncate the
+// message when relaying it, since it prefixes it with our nick, username and
+// hostname.
+func (s *Session) MaxContentLen(target string) int {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.maxContentLen(target)
+}
+
+func (s *Session) maxContentLen(target string) int {
+	lineLen := 512
+	if l, err := strconv.Atoi(s.features["LINELEN"]); err == nil && lineLen < l {
+		lineLen = l
+	}
+
+	host := len(s.host)
+	if host == 0 {
+		// We don't know our hostname yet, assume the longest one.
+		host = 63
+	}
+
+	// ":nick!~user@host PRIVMSG target :content\r\n"
+	overhead := len(s.nick) + len(s.user) + host + len(target) + 17
+
+	return lineLen - overhead
+}
+
+// act queues an action for the run goroutine, unless the session has stopped.
+func (s *Session) act(act action) {
+	select {
+	case s.acts <- act:
+	case <-s.done:
+	}
+}
+
 func (s *Session) SendRaw(raw string) {
-	s.acts <- actionSendRaw{raw}
+	s.act(actionSendRaw{raw})
 }
 
 func (s *Session) sendRaw(act actionSendRaw) (err error) {
-	err = s.send("%s\r\n", act.raw)
+	msg, err := ParseMessage(act.raw)
+	if err != nil {
+		return
+	}
+	err = s.send(msg)
 	return
 }
 
-func (s *Session) Join(channel string) {
-	s.acts <- actionJoin{channel}
+func (s *Session) Join(channel, key string) {
+	s.act(actionJoin{channel, key})
 }
 
 func (s *Session) join(act actionJoin) (err error) {
-	err = s.send("JOIN %s\r\n", act.Channel)
+	if act.Key == "" {
+		err = s.send(NewMessage("JOIN", act.Channel))
+	} else {
+		err = s.send(NewMessage("JOIN", act.Channel, act.Key))
+	}
 	return
 }
 
 func (s *Session) Part(channel, reason string) {
-	s.acts <- actionPart{channel, reason}
+	s.act(actionPart{channel, reason})
 }
 
 func (s *Session) part(act actionPart) (err error) {
-	err = s.send("PART %s :%s\r\n", act.Channel, act.Reason)
+	err = s.send(NewMessage("PART", act.Channel, act.Reason))
 	return
 }
 
 func (s *Session) SetTopic(channel, topic string) {
-	s.acts <- actionSetTopic{channel, topic}
+	s.act(actionSetTopic{channel, topic})
 }
 
 func (s *Session) setTopic(act actionSetTopic) (err error) {
-	err = s.send("TOPIC %s :%s\r\n", act.Channel, act.Topic)
+	err = s.send(NewMessage("TOPIC", act.Channel, act.Topic))
 	return
 }
 
 func (s *Session) PrivMsg(target, content string) {
-	s.acts <- actionPrivMsg{target, content}
+	s.act(actionPrivMsg{target, content, ""})
+}
+
+// Reply sends content to target, as a reply to the message whose msgid is
+// replyTo.  Without the message-tags capability, it is sent as a regular
+// message.
+func (s *Session) Reply(target, replyTo, content string) {
+	s.act(actionPrivMsg{target, content, replyTo})
 }
 
 func (s *Session) privMsg(act actionPrivMsg) (err error) {
-	err = s.send("PRIVMSG %s :%s\r\n", act.Target, act.Content)
+	maxLen := s.maxContentLen(act.Target)
+	if _, ok := s.enabledCaps["message-tags"]; !ok {
+		act.ReplyTo = ""
+	}
+	privmsg := func(content string) Message {
+		msg := NewMessage("PRIVMSG", act.Target, content)
+		if act.ReplyTo != "" {
+			msg = msg.WithTag("+draft/reply", act.ReplyTo)
+		}
+		return msg
+	}
+
+	// concat[i] is true when parts[i] is the continuation of parts[i-1],
+	// that is when both come from the same line that was too long.
+	var parts []string
+	var concat []bool
+	for _, line := range strings.Split(strings.Trim(act.Content, "\n"), "\n") {
+		for i, part := range SplitMessage(line, maxLen) {
+			parts = append(parts, part)
+			concat = append(concat, i != 0)
+		}
+	}
+
+	if _, ok := s.enabledCaps["draft/multiline"]; ok && 1 < len(parts) {
+		maxBytes, maxLines := s.multilineLimits()
+		for 0 < len(parts) {
+			n, size := 0, 0
+			for n < len(parts) && n < maxLines && size+len(parts[n]) <= maxBytes {
+				size += len(parts[n]) + 1
+				n++
+			}
+			if n == 0 {
+				// This part alone is bigger than max-bytes.
+				n = 1
+			}
+			if n == 1 && parts[0] != "" {
+				err = s.send(privmsg(parts[0]))
+			} else if 1 < n {
+				err = s.sendMultiline(act.Target, act.ReplyTo, parts[:n], concat[:n])
+			}
+			if err != nil {
+				return
+			}
+			parts = parts[n:]
+			concat = concat[n:]
+		}
+	} else {
+		for _, part := range parts {
+			if part == "" {
+				continue
+			}
+			err = s.send(privmsg(part))
+			if err != nil {
+				return
+			}
+		}
+	}
+
 	target := s.Casemap(act.Target)
 	delete(s.typingStamps, target)
 	return
 }
 
+// multilineLimits returns the max-bytes and max-lines values of the
+// draft/multiline capability.
+func (s *Session) multilineLimits() (maxBytes, maxLines int) {
+	maxBytes = 4096
+	maxLines = 1 << 30
+
+	for _, kv := range strings.Split(s.availableCaps["draft/multiline"], ",") {
+		kv := strings.SplitN(kv, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n <= 0 {
+			continue
+		}
+		switch kv[0] {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+
+	return
+}
+
+// sendMultiline sends lines in a draft/multiline batch.  If replyTo is not
+// empty, the batch is a reply to the message with this msgid.
+func (s *Session) sendMultiline(target, replyTo string, lines []string, concat []bool) (err error) {
+	s.batchID++
+	id := fmt.Sprintf("senpai%d", s.batchID)
+
+	msgs := make([]Message, 0, len(lines)+2)
+	start := NewMessage("BATCH", "+"+id, "draft/multiline", target)
+	if replyTo != "" {
+		start = start.WithTag("+draft/reply", replyTo)
+	}
+	msgs = append(msgs, start)
+	for i, line := range lines {
+		msg := NewMessage("PRIVMSG", target, line).WithTag("batch", id)
+		if i != 0 && concat[i] {
+			msg = msg.WithTag("draft/multiline-concat", "")
+		}
+		msgs = append(msgs, msg)
+	}
+	msgs = append(msgs, NewMessage("BATCH", "-"+id))
+
+	err = s.send(msgs...)
+	return
+}
+
 func (s *Session) Typing(channel string) {
-	s.acts <- actionTyping{channel}
+	s.act(actionTyping{channel})
 }
 
 func (s *Session) typing(act actionTyping) (err error) {
@@ -381,12 +812,12 @@ func (s *Session) typing(act actionTyping) (err error) {
 
 	s.typingStamps[to] = now
 
-	err = s.send("@+typing=active TAGMSG %s\r\n", act.Channel)
+	err = s.send(NewMessage("TAGMSG", act.Channel).WithTag("+typing", "active"))
 	return
 }
 
 func (s *Session) TypingStop(channel string) {
-	s.acts <- actionTypingStop{channel}
+	s.act(actionTypingStop{channel})
 }
 
 func (s *Session) typingStop(act actionTypingStop) (err error) {
@@ -394,12 +825,306 @@ func (s *Session) typingStop(act actionTypingStop) (err error) {
 		return
 	}
 
-	err = s.send("@+typing=done TAGMSG %s\r\n", act.Channel)
+	err = s.send(NewMessage("TAGMSG", act.Channel).WithTag("+typing", "done"))
+	return
+}
+
+// React reacts to the message of target whose msgid is msgID.  It does nothing
+// without the message-tags capability.
+func (s *Session) React(target, msgID, reaction string) {
+	s.act(actionReact{target, msgID, reaction})
+}
+
+func (s *Session) react(act actionReact) (err error) {
+	if _, ok := s.enabledCaps["message-tags"]; !ok {
+		return
+	}
+
+	msg := NewMessage("TAGMSG", act.Target).
+		WithTag("+draft/react", act.Reaction).
+		WithTag("+draft/reply", act.MsgID)
+	err = s.send(msg)
+	return
+}
+
+// RealName returns the real name of the user of the session.
+func (s *Session) RealName() string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.real
+}
+
+// SetName changes the real name of the user of the session.  It does nothing
+// without the setname capability.
+func (s *Session) SetName(realName string) {
+	s.act(actionSetName{realName})
+}
+
+func (s *Session) setName(act actionSetName) (err error) {
+	if _, ok := s.enabledCaps["setname"]; !ok {
+		return
+	}
+	err = s.send(NewMessage("SETNAME", act.RealName))
+	return
+}
+
+// AddNetwork asks the bouncer to add a network with the given attributes, such
+// as "name" and "host".  It does nothing without the soju.im/bouncer-networks
+// capability.
+func (s *Session) AddNetwork(attrs map[string]string) {
+	s.act(actionAddNetwork{attrs})
+}
+
+func (s *Session) addNetwork(act actionAddNetwork) (err error) {
+	if _, ok := s.enabledCaps["soju.im/bouncer-networks"]; !ok {
+		return
+	}
+	err = s.send(NewMessage("BOUNCER", "ADDNETWORK", formatAttrs(act.Attrs)))
+	return
+}
+
+// ChangeNetwork asks the bouncer to change the given attributes of the network
+// whose ID is netID.  Attributes set to "" are removed.  It does nothing
+// without the soju.im/bouncer-networks capability.
+func (s *Session) ChangeNetwork(netID string, attrs map[string]string) {
+	s.act(actionChangeNetwork{netID, attrs})
+}
+
+func (s *Session) changeNetwork(act actionChangeNetwork) (err error) {
+	if _, ok := s.enabledCaps["soju.im/bouncer-networks"]; !ok {
+		return
+	}
+	err = s.send(NewMessage("BOUNCER", "CHANGENETWORK", act.NetID, formatAttrs(act.Attrs)))
+	return
+}
+
+// Contact is a user whose presence is monitored.
+type Contact struct {
+	Name   string
+	Online bool
+}
+
+// Contacts returns the monitored users, sorted by name.  Those whose presence
+// is unknown are considered offline.
+func (s *Session) Contacts() (contacts []Contact) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	for nickCf, nick := range s.monitored {
+		contacts = append(contacts, Contact{
+			Name:   nick,
+			Online: s.online[nickCf],
+		})
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return strings.ToLower(contacts[i].Name) < strings.ToLower(contacts[j].Name)
+	})
+	return
+}
+
+// Monitor starts monitoring the presence of the given users, with MONITOR, or
+// WATCH if the server only supports the latter.  A PresenceEvent is sent
+// when they come online or go offline.  Users that don't fit within the limit
+// of the server are reported with an error, and monitored once others are
+// unmonitored.
+func (s *Session) Monitor(nicks ...string) {
+	s.act(actionMonitor{nicks, true})
+}
+
+// Unmonitor stops monitoring the presence of the given users.
+func (s *Session) Unmonitor(nicks ...string) {
+	s.act(actionMonitor{nicks, false})
+}
+
+func (s *Session) monitor(act actionMonitor) (err error) {
+	var changed []string
+	for _, nick := range act.Nicks {
+		nickCf := s.Casemap(nick)
+		_, ok := s.monitored[nickCf]
+		if act.Add == ok {
+			continue
+		}
+		if act.Add {
+			s.monitored[nickCf] = nick
+		} else {
+			delete(s.monitored, nickCf)
+			delete(s.online, nickCf)
+		}
+		changed = append(changed, nick)
+	}
+
+	if !s.monitorReady {
+		// They will be sent at the end of the registration.
+		return
+	}
+	err = s.sendMonitor(act.Add, changed)
+	if err != nil || act.Add {
+		return
+	}
+
+	// Some room has been made, use it for the users that didn't fit.
+	limit := s.monitorLimit()
+	if limit == 0 {
+		return
+	}
+	var pending []string
+	for nickCf, nick := range s.monitored {
+		if _, ok := s.watched[nickCf]; !ok {
+			pending = append(pending, nick)
+		}
+	}
+	sort.Strings(pending)
+	if room := limit - len(s.watched); room < len(pending) {
+		pending = pending[:room]
+	}
+	err = s.sendMonitor(true, pending)
+	return
+}
+
+// monitorLimit returns the maximum number of users that can be monitored, as
+// advertised by the server with the MONITOR or WATCH ISUPPORT token, or 0 if
+// there is no limit.
+func (s *Session) monitorLimit() int {
+	v, ok := s.features["MONITOR"]
+	if !ok {
+		v = s.features["WATCH"]
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// monitorChunk is the number of nicknames sent per MONITOR or WATCH message.
+const monitorChunk = 16
+
+func (s *Session) sendMonitor(add bool, nicks []string) (err error) {
+	_, monitor := s.features["MONITOR"]
+	_, watch := s.features["WATCH"]
+	if !monitor && !watch {
+		return
+	}
+
+	// Only send what changes for the server, and stop adding users once the
+	// limit is reached.
+	limit := s.monitorLimit()
+	var sent, dropped []string
+	for _, nick := range nicks {
+		nickCf := s.Casemap(nick)
+		_, ok := s.watched[nickCf]
+		if add == ok {
+			continue
+		}
+		if !add {
+			delete(s.watched, nickCf)
+		} else if 0 < limit && limit <= len(s.watched) {
+			dropped = append(dropped, nick)
+			continue
+		} else {
+			s.watched[nickCf] = struct{}{}
+		}
+		sent = append(sent, nick)
+	}
+	if len(dropped) != 0 {
+		s.emit(fmt.Errorf("the list of monitored users is full (%d), not monitoring %s", limit, strings.Join(dropped, ", ")))
+	}
+	nicks = sent
+
+	op := "-"
+	if add {
+		op = "+"
+	}
+	for 0 < len(nicks) {
+		n := len(nicks)
+		if monitorChunk < n {
+			n = monitorChunk
+		}
+		var msg Message
+		if monitor {
+			msg = NewMessage("MONITOR", op, strings.Join(nicks[:n], ","))
+		} else {
+			params := make([]string, n)
+			for i, nick := range nicks[:n] {
+				params[i] = op + nick
+			}
+			msg = NewMessage("WATCH", params...)
+		}
+		err = s.send(msg)
+		if err != nil {
+			return
+		}
+		nicks = nicks[n:]
+	}
+	return
+}
+
+// updatePresence records whether the given user is online, and emits a
+// PresenceEvent.
+func (s *Session) updatePresence(user *Prefix, online bool) {
+	nickCf := s.Casemap(user.Name)
+	if _, ok := s.monitored[nickCf]; !ok {
+		// The reply came after the user has been unmonitored.
+		return
+	}
+	s.online[nickCf] = online
+	s.emit(PresenceEvent{
+		User:   user,
+		Online: online,
+	})
+}
+
+// Redact deletes the message of target whose msgid is msgID.  It does nothing
+// without the draft/message-redaction capability.
+func (s *Session) Redact(target, msgID, reason string) {
+	s.act(actionRedact{target, msgID, reason})
+}
+
+func (s *Session) redact(act actionRedact) (err error) {
+	if _, ok := s.enabledCaps["draft/message-redaction"]; !ok {
+		return
+	}
+
+	msg := NewMessage("REDACT", act.Target, act.MsgID)
+	if act.Reason != "" {
+		msg.Params = append(msg.Params, act.Reason)
+	}
+	err = s.send(msg)
+	return
+}
+
+// ReadMarker returns the time of the last message of target that has been
+// read, or the zero time if it is unknown.
+func (s *Session) ReadMarker(target string) time.Time {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return s.readMarkers[s.Casemap(target)]
+}
+
+// SetReadMarker tells the server, and thus other clients, that the messages
+// of target up to t have been read.  Nothing is sent without the
+// draft/read-marker capability, or if the read marker is already after t.
+func (s *Session) SetReadMarker(target string, t time.Time) {
+	s.act(actionReadMarker{target, t})
+}
+
+func (s *Session) setReadMarker(act actionReadMarker) (err error) {
+	if _, ok := s.enabledCaps["draft/read-marker"]; !ok {
+		return
+	}
+
+	targetCf := s.Casemap(act.Target)
+	if !act.Time.After(s.readMarkers[targetCf]) {
+		return
+	}
+	s.readMarkers[targetCf] = act.Time
+
+	err = s.send(NewMessage("MARKREAD", act.Target, "timestamp="+formatTimestamp(act.Time)))
 	return
 }
 
 func (s *Session) RequestHistory(target string, before time.Time) {
-	s.acts <- actionRequestHistory{target, before}
+	s.act(actionRequestHistory{target, before})
 }
 
 func (s *Session) requestHistory(act actionRequestHistory) (err error) {
@@ -407,18 +1132,44 @@ func (s *Session) requestHistory(act actionRequestHistory) (err error) {
 		return
 	}
 
-	t := act.Before.UTC()
-	err = s.send("CHATHISTORY BEFORE %s timestamp=%04d-%02d-%02dT%02d:%02d:%02d.%03dZ 100\r\n", act.Target, t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()+1, t.Nanosecond()/1e6)
+	// Ask for a second more, so that messages sent in the same second as
+	// act.Before are not missed.
+	before := "timestamp=" + formatTimestamp(act.Before.Add(time.Second))
+	err = s.send(NewMessage("CHATHISTORY", "BEFORE", act.Target, before, "100"))
 
 	return
 }
 
+func (s *Session) quit(act actionQuit) (err error) {
+	s.quitting = true
+
+	if act.Reason == "" {
+		err = s.send(NewMessage("QUIT"))
+	} else {
+		err = s.send(NewMessage("QUIT", act.Reason))
+	}
+	return
+}
+
 func (s *Session) run() {
-	for s.Running() {
+	pings := time.NewTicker(s.pingInterval)
+	defer pings.Stop()
+
+	defer s.evts.Close()
+
+	for {
 		var err error
 
 		select {
+		case <-s.done:
+			for line := range s.lines {
+				if err := s.handleLine(line); err != nil {
+					s.emit(err)
+				}
+			}
+			return
 		case act := <-s.acts:
+			s.l.Lock()
 			switch act := act.(type) {
 			case actionSendRaw:
 				err = s.sendRaw(act)
@@ -434,60 +1185,119 @@ func (s *Session) run() {
 				err = s.typing(act)
 			case actionTypingStop:
 				err = s.typingStop(act)
+			case actionReact:
+				err = s.react(act)
+			case actionSetName:
+				err = s.setName(act)
+			case actionAddNetwork:
+				err = s.addNetwork(act)
+			case actionChangeNetwork:
+				err = s.changeNetwork(act)
+			case actionMonitor:
+				err = s.monitor(act)
+			case actionRedact:
+				err = s.redact(act)
+			case actionReadMarker:
+				err = s.setReadMarker(act)
 			case actionRequestHistory:
 				err = s.requestHistory(act)
+			case actionQuit:
+				err = s.quit(act)
 			}
-		case msg := <-s.msgs:
-			if s.registered {
-				err = s.handle(msg)
-			} else {
-				err = s.handleStart(msg)
+			s.l.Unlock()
+		case line, ok := <-s.lines:
+			if !ok {
+				// The reader has stopped the session, done is about
+				// to be closed.
+				<-s.done
+				return
 			}
+			err = s.handleLine(line)
 		case t := <-s.typings.Stops():
-			s.evts <- TagEvent{
-				User:   s.users[t.Name].Name,
-				Target: s.channels[t.Target].Name,
-				Typing: TypingDone,
-				Time:   time.Now(),
+			s.l.Lock()
+			if u, ok := s.users[t.Name]; ok {
+				s.emit(TagEvent{
+					User:   u.Name.Copy(),
+					Target: s.channels[t.Target].Name,
+					Typing: TypingDone,
+					Time:   time.Now(),
+				})
 			}
+			s.l.Unlock()
+		case <-pings.C:
+			s.l.Lock()
+			err = s.ping()
+			s.l.Unlock()
+		case <-s.pingDeadline:
+			s.l.Lock()
+			err = fmt.Errorf("connection timed out: no answer from the server after %s", s.pingTimeout)
+			s.l.Unlock()
+			_ = s.conn.Close()
 		}
 
 		if err != nil {
-			s.evts <- err
+			s.emit(err)
 		}
 	}
 }
 
-func (s *Session) handleStart(msg Message) (err error) {
-	switch msg.Command {
-	case "AUTHENTICATE":
-		if s.auth != nil {
-			var res string
+func (s *Session) emit(ev Event) {
+	s.evts.Push(ev)
+}
 
-			res, err = s.auth.Respond(msg.Params[0])
-			if err != nil {
-				err = s.send("AUTHENTICATE *\r\n")
-				return
-			}
+func (s *Session) handleLine(line string) (err error) {
+	msg, parseErr := ParseMessage(line)
+	if parseErr != nil {
+		return
+	}
 
-			err = s.send("AUTHENTICATE %s\r\n", res)
-			if err != nil {
-				return
-			}
-		}
-	case rplLoggedin:
-		err = s.send("CAP END\r\n")
-		if err != nil {
-			return
-		}
+	valid := msg.IsValid()
+	if s.debug {
+		s.emit(RawMessageEvent{Message: hideSecrets(msg, line), IsValid: valid})
+	}
+	if !valid {
+		return
+	}
+
+	h := s.handleMessage
+	for i := len(s.middlewares) - 1; 0 <= i; i-- {
+		h = s.middlewares[i](h)
+	}
+	err = h(msg)
+	return
+}
+
+// handleMessage is the innermost MessageHandler, which updates the state of
+// the session.
+func (s *Session) handleMessage(msg Message) (err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.registered {
+		err = s.handle(msg)
+	} else {
+		err = s.handleStart(msg)
+	}
+	return
+}
+
+// ping sends a PING to measure the lag, unless the previous one hasn't been
+// answered yet.
+func (s *Session) ping() (err error) {
+	if !s.registered || s.pingToken != "" {
+		return
+	}
 
-		s.acct = msg.Params[2]
-		s.host = ParsePrefix(msg.Params[1]).Host
-	case errNicklocked, errSaslfail, errSasltoolong, errSaslaborted, errSaslalready, rplSaslmechs:
-		err = s.send("CAP END\r\n")
-		if err != nil {
-			return
-		}
+	s.pingSent = time.Now()
+	s.pingToken = fmt.Sprintf("senpai-%d", s.pingSent.UnixNano())
+	s.pingDeadline = time.After(s.pingTimeout)
+
+	err = s.send(NewMessage("PING", s.pingToken))
+	return
+}
+
+func (s *Session) handleStart(msg Message) (err error) {
+	switch msg.Command {
 	case "CAP":
 		switch msg.Params[1] {
 		case "LS":
@@ -510,32 +1320,38 @@ func (s *Session) handleStart(msg Message) (err error) {
 				}
 			}
 
+			if v, ok := s.availableCaps["sts"]; ok && !willContinue {
+				if s.handleSTS(v) {
+					// Don't register in plaintext.
+					return
+				}
+			}
+
 			if !willContinue {
-				var req strings.Builder
+				var req []Message
 
 				for c := range s.availableCaps {
 					if _, ok := SupportedCapabilities[c]; !ok {
 						continue
 					}
 
-					_, _ = fmt.Fprintf(&req, "CAP REQ %s\r\n", c)
+					req = append(req, NewMessage("CAP", "REQ", c))
 				}
 
-				_, ok := s.availableCaps["sasl"]
-				if s.auth == nil || !ok {
-					_, _ = fmt.Fprintf(&req, "CAP END\r\n")
+				if !s.canAuthenticate() {
+					req = append(req, s.capEnd()...)
 				}
 
-				err = s.send(req.String())
+				err = s.send(req...)
 				if err != nil {
 					return
 				}
 			}
 		default:
-			s.handle(msg)
+			err = s.handle(msg)
 		}
 	case errNicknameinuse:
-		err = s.send("NICK %s_\r\n", msg.Params[1])
+		err = s.send(NewMessage("NICK", msg.Params[1]+"_"))
 		if err != nil {
 			return
 		}
@@ -547,12 +1363,10 @@ func (s *Session) handleStart(msg Message) (err error) {
 }
 
 func (s *Session) handle(msg Message) (err error) {
-	if id, ok := msg.Tags["batch"]; ok {
-		if b, ok := s.chBatches[id]; ok {
-			s.chBatches[id] = HistoryEvent{
-				Target:   b.Target,
-				Messages: append(b.Messages, s.privmsgToEvent(msg)),
-			}
+	if id, ok := msg.Tags["batch"]; ok && msg.Command != "BATCH" {
+		if b, ok := s.batches[id]; ok {
+			b.Event.Children = append(b.Event.Children, msg)
+			s.batches[id] = b
 			return
 		}
 	}
@@ -564,43 +1378,102 @@ func (s *Session) handle(msg Message) (err error) {
 		s.registered = true
 		s.users[s.nickCf] = &User{Name: &Prefix{
 			Name: s.nick, User: s.user, Host: s.host,
-		}}
-		s.evts <- RegisteredEvent{}
+		}, RealName: s.real}
+		s.emit(RegisteredEvent{})
 
 		if s.host == "" {
-			err = s.send("WHO %s\r\n", s.nick)
+			err = s.send(NewMessage("WHO", s.nick))
+			if err != nil {
+				return
+			}
+		}
+		if _, ok := s.enabledCaps["soju.im/bouncer-networks"]; ok && s.netID == "" {
+			err = s.send(NewMessage("BOUNCER", "LISTNETWORKS"))
+			if err != nil {
+				return
+			}
+		}
+		if s.acct == "" && s.nickServPass != "" {
+			err = s.send(NewMessage("PRIVMSG", "NickServ", "IDENTIFY "+s.nickServAcct+" "+s.nickServPass))
 			if err != nil {
 				return
 			}
 		}
 	case rplIsupport:
 		s.updateFeatures(msg.Params[1 : len(msg.Params)-1])
+	case rplEndofmotd, errNomotd:
+		if s.monitorReady {
+			break
+		}
+		// ISUPPORT is known by now.
+		s.monitorReady = true
+		var nicks []string
+		for _, nick := range s.monitored {
+			nicks = append(nicks, nick)
+		}
+		sort.Strings(nicks)
+		err = s.sendMonitor(true, nicks)
+	case rplMononline, rplMonoffline:
+		for _, target := range strings.Split(msg.Params[1], ",") {
+			if target == "" {
+				continue
+			}
+			s.updatePresence(ParsePrefix(target), msg.Command == rplMononline)
+		}
+	case rplLogon, rplNowon:
+		s.updatePresence(&Prefix{
+			Name: msg.Params[1],
+			User: msg.Params[2],
+			Host: msg.Params[3],
+		}, true)
+	case rplLogoff, rplNowoff:
+		s.updatePresence(&Prefix{Name: msg.Params[1]}, false)
+	case errMonlistfull, errToomanywatch:
+		targets := msg.Params[1]
+		if msg.Command == errMonlistfull {
+			targets = msg.Params[2]
+		}
+		// They will be sent again once some room is made.
+		var rejected []string
+		for _, target := range strings.Split(targets, ",") {
+			if target == "" {
+				continue
+			}
+			delete(s.watched, s.Casemap(target))
+			rejected = append(rejected, target)
+		}
+		s.emit(fmt.Errorf("the list of monitored users is full, not monitoring %s", strings.Join(rejected, ", ")))
 	case rplWhoreply:
-		if s.nickCf == s.Casemap(msg.Params[5]) {
+		nickCf := s.Casemap(msg.Params[5])
+		if s.nickCf == nickCf {
 			s.host = msg.Params[3]
 		}
+		if u, ok := s.users[nickCf]; ok {
+			u.Name.User = msg.Params[2]
+			u.Name.Host = msg.Params[3]
+			// The last parameter is "<hopcount> <real name>".
+			if _, realName := word(msg.Params[7]); realName != "" {
+				u.RealName = realName
+			}
+		}
 	case "CAP":
 		switch msg.Params[1] {
 		case "ACK":
 			for _, c := range strings.Split(msg.Params[2], " ") {
 				s.enabledCaps[c] = struct{}{}
 
-				if s.auth != nil && c == "sasl" {
-					h := s.auth.Handshake()
-					err = s.send("AUTHENTICATE %s\r\n", h)
+				if c == "sasl" && s.canAuthenticate() {
+					err = s.authenticate()
 					if err != nil {
 						return
 					}
 				} else if len(s.channels) != 0 && c == "multi-prefix" {
 					// TODO merge NAMES commands
-					var sb strings.Builder
-					sb.Grow(512)
+					var names []Message
 					for _, c := range s.channels {
-						sb.WriteString("NAMES ")
-						sb.WriteString(c.Name)
-						sb.WriteString("\r\n")
+						names = append(names, NewMessage("NAMES", c.Name))
 					}
-					err = s.send(sb.String())
+					err = s.send(names...)
 					if err != nil {
 						return
 					}
@@ -609,6 +1482,14 @@ func (s *Session) handle(msg Message) (err error) {
 		case "NAK":
 			for _, c := range strings.Split(msg.Params[2], " ") {
 				delete(s.enabledCaps, c)
+
+				if c == "sasl" && !s.registered && s.canAuthenticate() {
+					// We were waiting for SASL to end the negotiation.
+					err = s.send(s.capEnd()...)
+					if err != nil {
+						return
+					}
+				}
 			}
 		case "NEW":
 			diff := ParseCaps(msg.Params[2])
@@ -619,25 +1500,40 @@ func (s *Session) handle(msg Message) (err error) {
 				} else {
 					delete(s.availableCaps, c.Name)
 				}
+				if c.Name == "sts" && c.Enable {
+					if s.handleSTS(c.Value) {
+						return
+					}
+				}
+				if c.Name == "sasl" {
+					// Mechanisms may have changed, e.g. because a
+					// bouncer has reconnected to its upstream.
+					s.saslMechs = nil
+					s.saslTried = map[string]struct{}{}
+				}
 			}
 
-			var req strings.Builder
+			var req []Message
 
 			for _, c := range diff {
 				_, ok := SupportedCapabilities[c.Name]
 				if !c.Enable || !ok {
 					continue
 				}
+				if _, ok := s.enabledCaps[c.Name]; ok {
+					if c.Name == "sasl" && s.canAuthenticate() {
+						err = s.authenticate()
+						if err != nil {
+							return
+						}
+					}
+					continue
+				}
 
-				_, _ = fmt.Fprintf(&req, "CAP REQ %s\r\n", c.Name)
-			}
-
-			_, ok := s.availableCaps["sasl"]
-			if s.acct == "" && ok {
-				// TODO authenticate
+				req = append(req, NewMessage("CAP", "REQ", c.Name))
 			}
 
-			err = s.send(req.String())
+			err = s.send(req...)
 			if err != nil {
 				return
 			}
@@ -653,10 +1549,11 @@ func (s *Session) handle(msg Message) (err error) {
 					s.availableCaps[c.Name] = c.Value
 				} else {
 					delete(s.availableCaps, c.Name)
+					delete(s.enabledCaps, c.Name)
 				}
 			}
 
-			var req strings.Builder
+			var req []Message
 
 			for _, c := range diff {
 				_, ok := SupportedCapabilities[c.Name]
@@ -664,15 +1561,54 @@ func (s *Session) handle(msg Message) (err error) {
 					continue
 				}
 
-				_, _ = fmt.Fprintf(&req, "CAP REQ %s\r\n", c.Name)
+				req = append(req, NewMessage("CAP", "REQ", c.Name))
+			}
+
+			err = s.send(req...)
+			if err != nil {
+				return
 			}
+		}
+	case "AUTHENTICATE":
+		if s.auth == nil {
+			break
+		}
+
+		var res string
+		res, err = s.auth.Respond(msg.Params[0])
+		if err != nil {
+			err = s.send(NewMessage("AUTHENTICATE", "*"))
+			return
+		}
+
+		err = s.send(NewMessage("AUTHENTICATE", res))
+		if err != nil {
+			return
+		}
+	case rplLoggedin:
+		s.auth = nil
+		s.acct = msg.Params[2]
+		s.host = ParsePrefix(msg.Params[1]).Host
 
-			_, ok := s.availableCaps["sasl"]
-			if s.acct == "" && ok {
-				// TODO authenticate
+		if !s.registered {
+			err = s.send(s.capEnd()...)
+			if err != nil {
+				return
 			}
+		}
+	case rplSaslmechs:
+		s.saslMechs = strings.Split(msg.Params[1], ",")
+	case errSaslfail:
+		// Try the next mechanism.
+		err = s.authenticate()
+		if err != nil {
+			return
+		}
+	case errNicklocked, errSasltoolong, errSaslaborted, errSaslalready:
+		s.auth = nil
 
-			err = s.send(req.String())
+		if !s.registered {
+			err = s.send(s.capEnd()...)
 			if err != nil {
 				return
 			}
@@ -686,19 +1622,25 @@ func (s *Session) handle(msg Message) (err error) {
 				Name:    msg.Params[0],
 				Members: map[*User]string{},
 			}
-			s.evts <- SelfJoinEvent{Channel: msg.Params[0]}
+			s.emit(SelfJoinEvent{Channel: msg.Params[0]})
+			if _, ok := s.enabledCaps["draft/read-marker"]; ok {
+				err = s.send(NewMessage("MARKREAD", msg.Params[0]))
+			}
 		} else if c, ok := s.channels[channelCf]; ok {
 			if _, ok := s.users[nickCf]; !ok {
 				s.users[nickCf] = &User{Name: msg.Prefix.Copy()}
 			}
+			if _, ok := s.enabledCaps["extended-join"]; ok && 3 <= len(msg.Params) {
+				s.users[nickCf].RealName = msg.Params[2]
+			}
 			c.Members[s.users[nickCf]] = ""
 			t := msg.TimeOrNow()
 
-			s.evts <- UserJoinEvent{
+			s.emit(UserJoinEvent{
 				User:    msg.Prefix.Copy(),
 				Channel: c.Name,
 				Time:    t,
-			}
+			})
 		}
 	case "PART":
 		nickCf := s.Casemap(msg.Prefix.Name)
@@ -710,7 +1652,7 @@ func (s *Session) handle(msg Message) (err error) {
 				for u := range c.Members {
 					s.cleanUser(u)
 				}
-				s.evts <- SelfPartEvent{Channel: c.Name}
+				s.emit(SelfPartEvent{Channel: c.Name})
 			}
 		} else if c, ok := s.channels[channelCf]; ok {
 			if u, ok := s.users[nickCf]; ok {
@@ -718,11 +1660,11 @@ func (s *Session) handle(msg Message) (err error) {
 				s.cleanUser(u)
 				s.typings.Done(channelCf, nickCf)
 
-				s.evts <- UserPartEvent{
+				s.emit(UserPartEvent{
 					User:    msg.Prefix.Copy(),
 					Channel: c.Name,
 					Time:    msg.TimeOrNow(),
-				}
+				})
 			}
 		}
 	case "KICK":
@@ -735,7 +1677,7 @@ func (s *Session) handle(msg Message) (err error) {
 				for u := range c.Members {
 					s.cleanUser(u)
 				}
-				s.evts <- SelfPartEvent{Channel: c.Name}
+				s.emit(SelfPartEvent{Channel: c.Name})
 			}
 		} else if c, ok := s.channels[channelCf]; ok {
 			if u, ok := s.users[nickCf]; ok {
@@ -743,11 +1685,11 @@ func (s *Session) handle(msg Message) (err error) {
 				s.cleanUser(u)
 				s.typings.Done(channelCf, nickCf)
 
-				s.evts <- UserPartEvent{
+				s.emit(UserPartEvent{
 					User:    u.Name.Copy(),
 					Channel: c.Name,
 					Time:    msg.TimeOrNow(),
-				}
+				})
 			}
 		}
 	case "QUIT":
@@ -764,11 +1706,11 @@ func (s *Session) handle(msg Message) (err error) {
 				}
 			}
 
-			s.evts <- UserQuitEvent{
+			s.emit(UserQuitEvent{
 				User:     msg.Prefix.Copy(),
 				Channels: channels,
 				Time:     msg.TimeOrNow(),
-			}
+			})
 		}
 	case rplNamreply:
 		channelCf := s.Casemap(msg.Params[2])
@@ -815,19 +1757,27 @@ func (s *Session) handle(msg Message) (err error) {
 			c.TopicWho = msg.Prefix.Copy()
 			c.TopicTime = msg.TimeOrNow()
 			s.channels[channelCf] = c
-			s.evts <- TopicChangeEvent{
+			s.emit(TopicChangeEvent{
 				User:    msg.Prefix.Copy(),
 				Channel: c.Name,
 				Topic:   c.Topic,
 				Time:    c.TopicTime,
-			}
+			})
 		}
 	case "PRIVMSG", "NOTICE":
-		s.evts <- s.privmsgToEvent(msg)
+		if isIdentify(msg) {
+			// Our IDENTIFY, echoed back with echo-message.
+			break
+		}
+		s.emit(s.privmsgToEvent(msg))
 	case "TAGMSG":
 		nickCf := s.Casemap(msg.Prefix.Name)
 		targetCf := s.Casemap(msg.Params[0])
 
+		if ev, ok := s.reactionToEvent(msg); ok {
+			// Reactions from self are echoed like messages.
+			s.emit(ev)
+		}
 		if nickCf == s.nickCf {
 			// TAGMSG from self
 			break
@@ -859,16 +1809,72 @@ func (s *Session) handle(msg Message) (err error) {
 			ev.Target = c.Name
 			ev.TargetIsChannel = true
 		}
-		s.evts <- ev
+		s.emit(ev)
+	case "REDACT":
+		s.emit(s.redactToEvent(msg))
+	case "BOUNCER":
+		switch msg.Params[0] {
+		case "NETWORK":
+			if len(msg.Params) < 3 {
+				break
+			}
+			ev := BouncerNetworkEvent{ID: msg.Params[1]}
+			if msg.Params[2] == "*" {
+				ev.Deleted = true
+			} else {
+				ev.Attrs = parseAttrs(msg.Params[2])
+			}
+			s.emit(ev)
+		case "ADDNETWORK", "CHANGENETWORK":
+			if _, ok := s.enabledCaps["soju.im/bouncer-networks-notify"]; !ok {
+				// Nothing tells about the change, list the networks again.
+				err = s.send(NewMessage("BOUNCER", "LISTNETWORKS"))
+			}
+		}
+	case "MARKREAD":
+		targetCf := s.Casemap(msg.Params[0])
+		var t time.Time
+		if ts := strings.TrimPrefix(msg.Params[1], "timestamp="); ts != msg.Params[1] {
+			var ok bool
+			t, ok = parseTimestamp(ts)
+			if !ok {
+				break
+			}
+		}
+		if t.Before(s.readMarkers[targetCf]) {
+			break
+		}
+		s.readMarkers[targetCf] = t
+
+		ev := ReadMarkerEvent{
+			Target: msg.Params[0],
+			Time:   t,
+		}
+		if c, ok := s.channels[targetCf]; ok {
+			ev.Target = c.Name
+		}
+		s.emit(ev)
 	case "BATCH":
 		batchStart := msg.Params[0][0] == '+'
 		id := msg.Params[0][1:]
 
-		if batchStart && msg.Params[1] == "chathistory" {
-			s.chBatches[id] = HistoryEvent{Target: msg.Params[2]}
-		} else if b, ok := s.chBatches[id]; ok {
-			s.evts <- b
-			delete(s.chBatches, id)
+		if batchStart {
+			s.batches[id] = batch{
+				Outer: msg.Tags["batch"],
+				Event: BatchEvent{
+					Type:   msg.Params[1],
+					Params: msg.Params[2:],
+					Tags:   msg.Tags,
+				},
+			}
+		} else if b, ok := s.batches[id]; ok {
+			delete(s.batches, id)
+			if outer, ok := s.batches[b.Outer]; ok {
+				outer.Event.Children = append(outer.Event.Children, b.Event)
+				s.batches[b.Outer] = outer
+			} else {
+				err = s.handleBatch(b.Event)
+			}
 		}
 	case "NICK":
 		nickCf := s.Casemap(msg.Prefix.Name)
@@ -887,41 +1893,311 @@ func (s *Session) handle(msg Message) (err error) {
 		}
 
 		if nickCf == s.nickCf {
-			s.evts <- SelfNickEvent{
+			s.emit(SelfNickEvent{
 				FormerNick: s.nick,
 				Time:       t,
-			}
+			})
 			s.nick = newNick
 			s.nickCf = newNickCf
 		} else {
-			s.evts <- UserNickEvent{
+			s.emit(UserNickEvent{
 				User:       u,
 				FormerNick: msg.Prefix.Name,
 				Time:       t,
-			}
+			})
+		}
+	case "RENAME":
+		formerCf := s.Casemap(msg.Params[0])
+		nameCf := s.Casemap(msg.Params[1])
+		c, ok := s.channels[formerCf]
+		if !ok {
+			break
+		}
+
+		ev := ChannelRenameEvent{
+			FormerName: c.Name,
+			Name:       msg.Params[1],
+			Time:       msg.TimeOrNow(),
+		}
+		if 2 < len(msg.Params) {
+			ev.Reason = msg.Params[2]
+		}
+
+		c.Name = msg.Params[1]
+		delete(s.channels, formerCf)
+		s.channels[nameCf] = c
+		if t, ok := s.readMarkers[formerCf]; ok {
+			delete(s.readMarkers, formerCf)
+			s.readMarkers[nameCf] = t
+		}
+		delete(s.typingStamps, formerCf)
+		s.typings.Clear(formerCf)
+
+		s.emit(ev)
+	case "SETNAME":
+		nickCf := s.Casemap(msg.Prefix.Name)
+		if nickCf == s.nickCf {
+			s.real = msg.Params[0]
+		}
+		u, ok := s.users[nickCf]
+		if !ok {
+			break
+		}
+		u.RealName = msg.Params[0]
+		s.emit(SetNameEvent{
+			User:     u.Name.Copy(),
+			RealName: u.RealName,
+			Time:     msg.TimeOrNow(),
+		})
+	case "CHGHOST":
+		nickCf := s.Casemap(msg.Prefix.Name)
+		if nickCf == s.nickCf {
+			s.user = msg.Params[0]
+			s.host = msg.Params[1]
+		}
+		u, ok := s.users[nickCf]
+		if !ok {
+			break
 		}
+		u.Name.User = msg.Params[0]
+		u.Name.Host = msg.Params[1]
+		s.emit(ChangeHostEvent{
+			User:       u.Name.Copy(),
+			FormerUser: msg.Prefix.User,
+			FormerHost: msg.Prefix.Host,
+			Time:       msg.TimeOrNow(),
+		})
 	case "FAIL":
-		s.evts <- RawMessageEvent{
+		s.emit(RawMessageEvent{
 			Message: msg.String(),
 			IsValid: true,
-		}
+		})
 	case "PING":
-		err = s.send("PONG :%s\r\n", msg.Params[0])
+		err = s.send(NewMessage("PONG", msg.Params[0]))
 		if err != nil {
 			return
 		}
+	case "PONG":
+		if s.pingToken == "" || msg.Params[len(msg.Params)-1] != s.pingToken {
+			break
+		}
+
+		s.emit(LagEvent{Lag: time.Since(s.pingSent)})
+		s.pingToken = ""
+		s.pingDeadline = nil
 	case "ERROR":
+		_ = s.conn.Close()
+		if s.quitting {
+			// The server acknowledges our QUIT.
+			break
+		}
 		err = errors.New("connection terminated")
 		if len(msg.Params) > 0 {
 			err = fmt.Errorf("connection terminated: %s", msg.Params[0])
 		}
-		_ = s.conn.Close()
 	default:
 	}
 
 	return
 }
 
+// handleSTS applies the STS policy advertised by the server.  On plaintext
+// connections, it closes the connection so that the client reconnects over
+// TLS, and returns true.
+func (s *Session) handleSTS(value string) (upgrade bool) {
+	params := map[string]string{}
+	for _, kv := range strings.Split(value, ",") {
+		kv := strings.SplitN(kv, "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+
+	if !s.secure {
+		port, err := strconv.Atoi(params["port"])
+		if err != nil || port <= 0 || 65535 < port {
+			return false
+		}
+		s.emit(STSUpgradeEvent{Port: port})
+		_ = s.conn.Close()
+		return true
+	}
+
+	duration, err := strconv.ParseUint(params["duration"], 10, 32)
+	if err != nil {
+		return false
+	}
+	_, preload := params["preload"]
+	s.emit(STSPolicyEvent{
+		Duration: time.Duration(duration) * time.Second,
+		Preload:  preload,
+	})
+	return false
+}
+
+// canAuthenticate reports whether one of the SASL clients of the session can
+// log in with the mechanisms advertised by the server.
+func (s *Session) canAuthenticate() bool {
+	if s.acct != "" {
+		return false
+	}
+	if v, ok := s.availableCaps["sasl"]; !ok {
+		return false
+	} else if v != "" {
+		s.saslMechs = strings.Split(v, ",")
+	}
+
+	return s.nextAuth() != nil
+}
+
+// nextAuth returns the first SASL client, in order of preference, whose
+// mechanism is supported by the server and hasn't been tried yet.
+func (s *Session) nextAuth() SASLClient {
+	for _, auth := range s.auths {
+		mech := auth.Handshake()
+		if _, ok := s.saslTried[mech]; ok {
+			continue
+		}
+		if s.saslMechs == nil {
+			return auth
+		}
+		for _, m := range s.saslMechs {
+			if strings.EqualFold(m, mech) {
+				return auth
+			}
+		}
+	}
+	return nil
+}
+
+// capEnd returns the messages that end the negotiation of capabilities, after
+// binding the session to its network if the server is a bouncer.
+func (s *Session) capEnd() (msgs []Message) {
+	if _, ok := s.availableCaps["soju.im/bouncer-networks"]; ok && s.netID != "" {
+		msgs = append(msgs, NewMessage("BOUNCER", "BIND", s.netID))
+	}
+	msgs = append(msgs, NewMessage("CAP", "END"))
+	return
+}
+
+// authenticate starts the SASL authentication with the next mechanism.  If
+// there is none left to try during registration, it ends the negotiation of
+// capabilities instead.
+func (s *Session) authenticate() (err error) {
+	s.auth = s.nextAuth()
+	if s.auth == nil {
+		if !s.registered {
+			err = s.send(s.capEnd()...)
+		}
+		return
+	}
+
+	mech := s.auth.Handshake()
+	s.saslTried[mech] = struct{}{}
+	err = s.send(NewMessage("AUTHENTICATE", mech))
+	return
+}
+
+// batchHandlers maps batch types to the functions that process them once they
+// are closed.  Batches of other types are unwrapped and their content is
+// handled as if it had been received outside of any batch.
+var batchHandlers map[string]func(s *Session, b BatchEvent) error
+
+func init() {
+	batchHandlers = map[string]func(s *Session, b BatchEvent) error{
+		"chathistory":     (*Session).handleHistoryBatch,
+		"draft/multiline": (*Session).handleMultilineBatch,
+	}
+}
+
+func (s *Session) handleBatch(b BatchEvent) (err error) {
+	if h, ok := batchHandlers[b.Type]; ok {
+		err = h(s, b)
+		return
+	}
+
+	for _, child := range b.Children {
+		switch child := child.(type) {
+		case Message:
+			err = s.handle(child)
+		case BatchEvent:
+			err = s.handleBatch(child)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	s.emit(b)
+	return
+}
+
+func (s *Session) handleHistoryBatch(b BatchEvent) (err error) {
+	ev := HistoryEvent{Target: b.Params[0]}
+
+	for _, child := range b.Children {
+		switch child := child.(type) {
+		case Message:
+			if isIdentify(child) {
+				continue
+			} else if child.Command == "PRIVMSG" || child.Command == "NOTICE" {
+				ev.Messages = append(ev.Messages, s.privmsgToEvent(child))
+			} else if r, ok := s.reactionToEvent(child); ok {
+				ev.Messages = append(ev.Messages, r)
+			} else if child.Command == "REDACT" {
+				ev.Messages = append(ev.Messages, s.redactToEvent(child))
+			}
+		case BatchEvent:
+			if child.Type != "draft/multiline" {
+				continue
+			}
+			if msg, ok := s.multilineToEvent(child); ok {
+				ev.Messages = append(ev.Messages, msg)
+			}
+		}
+	}
+
+	s.emit(ev)
+	return
+}
+
+func (s *Session) handleMultilineBatch(b BatchEvent) (err error) {
+	if ev, ok := s.multilineToEvent(b); ok {
+		s.emit(ev)
+	}
+	return
+}
+
+// multilineToEvent reassembles the content of a draft/multiline batch into a
+// single MessageEvent, whose lines are separated by "\n".
+func (s *Session) multilineToEvent(b BatchEvent) (ev MessageEvent, ok bool) {
+	var sb strings.Builder
+
+	for _, child := range b.Children {
+		msg, isMsg := child.(Message)
+		if !isMsg || (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") {
+			continue
+		}
+		if !ok {
+			ev = s.privmsgToEvent(msg)
+			ok = true
+		} else if _, concat := msg.Tags["draft/multiline-concat"]; !concat {
+			sb.WriteRune('\n')
+		}
+		sb.WriteString(msg.Params[1])
+	}
+
+	ev.Content = sb.String()
+	if ok {
+		// Tags of the multiline message are on the batch itself.
+		ev.ID = b.Tags["msgid"]
+		ev.ReplyTo = b.Tags["+draft/reply"]
+	}
+	return
+}
+
 func (s *Session) privmsgToEvent(msg Message) (ev MessageEvent) {
 	targetCf := s.Casemap(msg.Params[0])
 
@@ -932,6 +2208,8 @@ func (s *Session) privmsgToEvent(msg Message) (ev MessageEvent) {
 		Command: msg.Command,
 		Content: msg.Params[1],
 		Time:    msg.TimeOrNow(),
+		ID:      msg.Tags["msgid"],
+		ReplyTo: msg.Tags["+draft/reply"],
 	}
 	if c, ok := s.channels[targetCf]; ok {
 		ev.Target = c.Name
@@ -941,6 +2219,48 @@ func (s *Session) privmsgToEvent(msg Message) (ev MessageEvent) {
 	return
 }
 
+// reactionToEvent returns the reaction carried by a TAGMSG, if any.
+func (s *Session) reactionToEvent(msg Message) (ev ReactionEvent, ok bool) {
+	if msg.Command != "TAGMSG" {
+		return
+	}
+	reaction := msg.Tags["+draft/react"]
+	msgID := msg.Tags["+draft/reply"]
+	if reaction == "" || msgID == "" {
+		return
+	}
+
+	ev = ReactionEvent{
+		User:     msg.Prefix.Copy(), // TODO correctly casemap
+		Target:   msg.Params[0],     // TODO correctly casemap
+		MsgID:    msgID,
+		Reaction: reaction,
+		Time:     msg.TimeOrNow(),
+	}
+	if c, ok := s.channels[s.Casemap(msg.Params[0])]; ok {
+		ev.Target = c.Name
+		ev.TargetIsChannel = true
+	}
+	return ev, true
+}
+
+func (s *Session) redactToEvent(msg Message) (ev RedactEvent) {
+	ev = RedactEvent{
+		User:   msg.Prefix.Copy(), // TODO correctly casemap
+		Target: msg.Params[0],     // TODO correctly casemap
+		MsgID:  msg.Params[1],
+		Time:   msg.TimeOrNow(),
+	}
+	if 2 < len(msg.Params) {
+		ev.Reason = msg.Params[2]
+	}
+	if c, ok := s.channels[s.Casemap(msg.Params[0])]; ok {
+		ev.Target = c.Name
+		ev.TargetIsChannel = true
+	}
+	return
+}
+
 func (s *Session) cleanUser(parted *User) {
 	for _, c := range s.channels {
 		if _, ok := c.Members[parted]; ok {
@@ -983,20 +2303,64 @@ func (s *Session) updateFeatures(features []string) {
 	}
 }
 
-func (s *Session) send(format string, args ...interface{}) (err error) {
-	msg := fmt.Sprintf(format, args...)
-	_, err = s.conn.Write([]byte(msg))
+// send queues the given messages, in order.  If one of them is invalid,
+// nothing is sent.  PINGs, PONGs, QUITs and the messages sent during
+// registration skip the queue, so that the lag is measured without it.
+func (s *Session) send(msgs ...Message) (err error) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	urgent := !s.registered
+	lines := make([]string, len(msgs))
+	for i := range msgs {
+		lines[i], err = msgs[i].Line()
+		if err != nil {
+			return
+		}
+		switch msgs[i].Command {
+		case "PING", "PONG", "QUIT":
+			urgent = true
+		}
+	}
+
+	err = s.out.Push(urgent, lines...)
 
 	if s.debug {
-		for _, line := range strings.Split(msg, "\r\n") {
-			if line != "" {
-				s.evts <- RawMessageEvent{
-					Message:  line,
-					Outgoing: true,
-				}
-			}
+		for i, line := range lines {
+			s.emit(RawMessageEvent{
+				Message:  hideSecrets(msgs[i], line),
+				Outgoing: true,
+			})
 		}
 	}
 
 	return
 }
+
+// hideSecrets returns line, the encoding of msg, with the passwords it
+// contains (PASS, NickServ IDENTIFY) replaced by stars, so that they don't
+// end up on screen in debug mode.
+func hideSecrets(msg Message, line string) string {
+	switch {
+	case msg.Command == "PASS" && len(msg.Params) > 0:
+		msg.Params = []string{"********"}
+	case isIdentify(msg):
+		fields := strings.Fields(msg.Params[1])
+		fields[len(fields)-1] = "********"
+		msg.Params = []string{msg.Params[0], strings.Join(fields, " ")}
+	default:
+		return line
+	}
+	return msg.String()
+}
+
+// isIdentify returns whether msg is a PRIVMSG that identifies to NickServ, and
+// thus contains a password.
+func isIdentify(msg Message) bool {
+	if msg.Command != "PRIVMSG" || len(msg.Params) < 2 || CasemapASCII(msg.Params[0]) != "nickserv" {
+		return false
+	}
+	fields := strings.Fields(msg.Params[1])
+	return 2 <= len(fields) && strings.ToUpper(fields[0]) == "IDENTIFY"
+}
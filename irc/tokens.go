@@ -3,9 +3,11 @@ package irc
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 func CasemapASCII(name string) string {
@@ -125,6 +127,32 @@ func parseTags(s string) (tags map[string]string) {
 	return
 }
 
+// parseAttrs parses the attributes of a bouncer network, which are encoded
+// like message tags (soju.im/bouncer-networks extension).
+func parseAttrs(s string) (attrs map[string]string) {
+	return parseTags("@" + s)
+}
+
+// formatAttrs encodes the attributes of a bouncer network, in a stable order.
+func formatAttrs(attrs map[string]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, k := range keys {
+		if i != 0 {
+			sb.WriteRune(';')
+		}
+		sb.WriteString(k)
+		sb.WriteRune('=')
+		sb.WriteString(escapeTagValue(attrs[k]))
+	}
+	return sb.String()
+}
+
 var (
 	errEmptyMessage      = errors.New("empty message")
 	errIncompleteMessage = errors.New("message is incomplete")
@@ -197,6 +225,23 @@ type Message struct {
 	Params  []string
 }
 
+// NewMessage returns a message to be sent to the server.  Use Line to turn it
+// into a string that is safe to send.
+func NewMessage(command string, params ...string) Message {
+	return Message{Command: command, Params: params}
+}
+
+// WithTag returns a copy of msg with the given tag set to value.
+func (msg Message) WithTag(key, value string) Message {
+	tags := make(map[string]string, len(msg.Tags)+1)
+	for k, v := range msg.Tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	msg.Tags = tags
+	return msg
+}
+
 func ParseMessage(line string) (msg Message, err error) {
 	line = strings.TrimLeft(line, " ")
 	if line == "" {
@@ -263,15 +308,19 @@ func (msg *Message) IsReply() bool {
 func (msg *Message) String() string {
 	var sb strings.Builder
 
-	if msg.Tags != nil {
+	if len(msg.Tags) != 0 {
 		sb.WriteRune('@')
+		first := true
 		for k, v := range msg.Tags {
+			if !first {
+				sb.WriteRune(';')
+			}
+			first = false
 			sb.WriteString(k)
 			if v != "" {
 				sb.WriteRune('=')
 				sb.WriteString(escapeTagValue(v))
 			}
-			sb.WriteRune(';')
 		}
 		sb.WriteRune(' ')
 	}
@@ -297,21 +346,88 @@ func (msg *Message) String() string {
 	return sb.String()
 }
 
+// trailingReplacer removes the characters that cannot appear in the last
+// parameter of a message.
+var trailingReplacer = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+// Line returns msg as it must be written to the server, without the trailing
+// CRLF.  Carriage returns, line feeds and NUL characters are removed from the
+// last parameter.  An error is returned if the command, the tag keys, the
+// prefix or the other parameters cannot be written without altering the
+// meaning of the message.
+func (msg *Message) Line() (line string, err error) {
+	if msg.Command == "" || strings.IndexFunc(msg.Command, isNotAlphanumeric) != -1 {
+		err = fmt.Errorf("invalid command %q", msg.Command)
+		return
+	}
+	for k := range msg.Tags {
+		if k == "" || strings.ContainsAny(k, " ;=\r\n\x00") {
+			err = fmt.Errorf("invalid tag key %q", k)
+			return
+		}
+	}
+	if strings.ContainsAny(msg.Prefix.String(), " \r\n\x00") {
+		err = fmt.Errorf("invalid prefix %q", msg.Prefix.String())
+		return
+	}
+
+	safe := *msg
+	if len(msg.Params) != 0 {
+		last := len(msg.Params) - 1
+		for _, p := range msg.Params[:last] {
+			if p == "" || p[0] == ':' || strings.ContainsAny(p, " \r\n\x00") {
+				err = fmt.Errorf("invalid parameter %q", p)
+				return
+			}
+		}
+		safe.Params = make([]string, len(msg.Params))
+		copy(safe.Params, msg.Params[:last])
+		safe.Params[last] = trailingReplacer.Replace(msg.Params[last])
+	}
+
+	line = safe.String()
+	return
+}
+
+func isNotAlphanumeric(r rune) bool {
+	return !('0' <= r && r <= '9' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z')
+}
+
 func (msg *Message) IsValid() bool {
 	switch msg.Command {
 	case "AUTHENTICATE", "PING", "PONG":
 		return 1 <= len(msg.Params)
+	case "MARKREAD":
+		return 2 <= len(msg.Params)
+	case "ERROR":
+		return true
+	case errNicklocked, rplSaslsuccess, errSaslfail, errSasltoolong, errSaslaborted, errSaslalready:
+		return 1 <= len(msg.Params)
+	case rplSaslmechs:
+		return 2 <= len(msg.Params)
+	case rplEndofmotd, errNomotd:
+		return 1 <= len(msg.Params)
 	case rplEndofnames, rplLoggedout, rplMotd, errNicknameinuse, rplNotopic, rplWelcome, rplYourhost:
 		return 2 <= len(msg.Params)
+	case rplMononline, rplMonoffline, errToomanywatch:
+		return 2 <= len(msg.Params)
+	case errMonlistfull:
+		return 3 <= len(msg.Params)
+	case rplLogon, rplLogoff, rplNowon, rplNowoff:
+		return 4 <= len(msg.Params)
 	case rplIsupport, rplLoggedin, rplTopic:
 		return 3 <= len(msg.Params)
 	case rplNamreply:
 		return 4 <= len(msg.Params)
 	case rplWhoreply:
 		return 8 <= len(msg.Params)
-	case "JOIN", "NICK", "PART", "TAGMSG":
+	case "JOIN", "NICK", "PART", "SETNAME", "TAGMSG":
 		return 1 <= len(msg.Params) && msg.Prefix != nil
-	case "KICK", "PRIVMSG", "NOTICE", "TOPIC":
+	case "REDACT":
+		return 2 <= len(msg.Params) && msg.Prefix != nil
+	case "BOUNCER":
+		return 2 <= len(msg.Params)
+	case "CHGHOST", "KICK", "PRIVMSG", "NOTICE", "RENAME", "TOPIC":
 		return 2 <= len(msg.Params) && msg.Prefix != nil
 	case "QUIT":
 		return msg.Prefix != nil
@@ -341,10 +457,10 @@ func (msg *Message) IsValid() bool {
 				return false
 			}
 			switch msg.Params[1] {
-			case "chathistory":
+			case "chathistory", "draft/multiline":
 				return 3 <= len(msg.Params)
 			default:
-				return false
+				return true
 			}
 		}
 		return msg.Params[0][0] == '-'
@@ -354,26 +470,36 @@ func (msg *Message) IsValid() bool {
 }
 
 func (msg *Message) Time() (t time.Time, ok bool) {
-	var tag string
-	var year, month, day, hour, minute, second, millis int
-
-	tag, ok = msg.Tags["time"]
+	tag, ok := msg.Tags["time"]
 	if !ok {
 		return
 	}
+	return parseTimestamp(tag)
+}
+
+// parseTimestamp parses timestamps in the format of the server-time
+// extension, such as "2020-01-01T12:00:00.000Z".
+func parseTimestamp(s string) (t time.Time, ok bool) {
+	var year, month, day, hour, minute, second, millis int
 
-	tag = strings.TrimSuffix(tag, "Z")
+	s = strings.TrimSuffix(s, "Z")
 
-	_, err := fmt.Sscanf(tag, "%4d-%2d-%2dT%2d:%2d:%2d.%3d", &year, &month, &day, &hour, &minute, &second, &millis)
+	_, err := fmt.Sscanf(s, "%4d-%2d-%2dT%2d:%2d:%2d.%3d", &year, &month, &day, &hour, &minute, &second, &millis)
 	if err != nil || month < 1 || 12 < month {
-		ok = false
 		return
 	}
 
 	t = time.Date(year, time.Month(month), day, hour, minute, second, millis*1e6, time.UTC)
+	ok = true
 	return
 }
 
+// formatTimestamp formats t in the format of the server-time extension.
+func formatTimestamp(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%04d-%02d-%02dT%02d:%02d:%02d.%03dZ", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e6)
+}
+
 func (msg *Message) TimeOrNow() time.Time {
 	t, ok := msg.Time()
 	if ok {
@@ -382,6 +508,42 @@ func (msg *Message) TimeOrNow() time.Time {
 	return time.Now().UTC()
 }
 
+// SplitMessage splits the content of a PRIVMSG into parts of at most maxLen
+// bytes.  Parts are cut after a space when possible, and never in the middle of
+// a UTF-8 sequence, so that their concatenation is equal to content.  CTCP
+// ACTIONs are split into several ACTIONs.
+func SplitMessage(content string, maxLen int) (parts []string) {
+	if maxLen < len(content) && strings.HasPrefix(content, "\x01ACTION ") && strings.HasSuffix(content, "\x01") {
+		for _, part := range SplitMessage(content[8:len(content)-1], maxLen-9) {
+			parts = append(parts, "\x01ACTION "+part+"\x01")
+		}
+		return
+	}
+
+	if maxLen < utf8.UTFMax {
+		maxLen = utf8.UTFMax
+	}
+
+	for maxLen < len(content) {
+		i := strings.LastIndexByte(content[:maxLen], ' ') + 1
+		if i == 0 {
+			i = maxLen
+			for 0 < i && !utf8.RuneStart(content[i]) {
+				i--
+			}
+			if i == 0 {
+				// Not valid UTF-8 anyway.
+				i = maxLen
+			}
+		}
+		parts = append(parts, content[:i])
+		content = content[i:]
+	}
+	parts = append(parts, content)
+
+	return
+}
+
 type Cap struct {
 	Name   string
 	Value  string
@@ -418,6 +580,7 @@ func ParseCaps(caps string) (diff []Cap) {
 type Member struct {
 	PowerLevel string
 	Name       *Prefix
+	RealName   string // empty if unknown
 }
 
 func ParseNameReply(trailing string, prefixes string) (names []Member) {
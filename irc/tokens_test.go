@@ -0,0 +1,68 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func assertSplitMessage(t *testing.T, content string, maxLen int, expected []string) {
+	actual := SplitMessage(content, maxLen)
+
+	if strings.Join(actual, "|") != strings.Join(expected, "|") {
+		t.Errorf("%q (maxLen=%d): expected to be split as %q, got %q", content, maxLen, expected, actual)
+	}
+	for _, part := range actual {
+		if maxLen < len(part) {
+			t.Errorf("%q (maxLen=%d): part %q is too long", content, maxLen, part)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	assertSplitMessage(t, "", 10, []string{""})
+	assertSplitMessage(t, "hello", 10, []string{"hello"})
+	assertSplitMessage(t, "hello world", 11, []string{"hello world"})
+	assertSplitMessage(t, "hello world", 10, []string{"hello ", "world"})
+	assertSplitMessage(t, "hello world", 6, []string{"hello ", "world"})
+	assertSplitMessage(t, "hello world", 5, []string{"hello", " ", "world"})
+	assertSplitMessage(t, "0123456789", 4, []string{"0123", "4567", "89"})
+
+	// "é" is 2 bytes long, "黒" is 3 bytes long.
+	assertSplitMessage(t, "ééé", 5, []string{"éé", "é"})
+	assertSplitMessage(t, "a黒黒", 5, []string{"a黒", "黒"})
+
+	assertSplitMessage(t, "\x01ACTION waves at everyone\x01", 20, []string{
+		"\x01ACTION waves at \x01",
+		"\x01ACTION everyone\x01",
+	})
+}
+
+func assertLine(t *testing.T, msg Message, expected string) {
+	actual, err := msg.Line()
+	if err != nil {
+		t.Errorf("%#v: expected line %q, got error %v", msg, expected, err)
+	} else if actual != expected {
+		t.Errorf("%#v: expected line %q, got %q", msg, expected, actual)
+	}
+}
+
+func assertLineError(t *testing.T, msg Message) {
+	if actual, err := msg.Line(); err == nil {
+		t.Errorf("%#v: expected an error, got line %q", msg, actual)
+	}
+}
+
+func TestMessageLine(t *testing.T) {
+	assertLine(t, NewMessage("PING", "hello"), "PING :hello")
+	assertLine(t, NewMessage("TOPIC", "#senpai", "a\r\nQUIT :bye"), "TOPIC #senpai :aQUIT :bye")
+	assertLine(t, NewMessage("PART", "#senpai", ""), "PART #senpai :")
+	assertLine(t, NewMessage("TAGMSG", "#senpai").WithTag("+typing", "active"), "@+typing=active TAGMSG :#senpai")
+	assertLine(t, NewMessage("TAGMSG", "#senpai").WithTag("+draft/reply", "a;b c"), "@+draft/reply=a\\:b\\sc TAGMSG :#senpai")
+
+	assertLineError(t, NewMessage("PRIVMSG", "#a\r\nQUIT", "hi"))
+	assertLineError(t, NewMessage("PRIVMSG", "#a b", "hi"))
+	assertLineError(t, NewMessage("PRIVMSG", ":a", "hi"))
+	assertLineError(t, NewMessage("PRIVMSG", "", "hi"))
+	assertLineError(t, NewMessage("PRIVMSG\r\nQUIT", "#a", "hi"))
+	assertLineError(t, NewMessage("TAGMSG", "#a").WithTag("a b", ""))
+}
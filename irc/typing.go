@@ -57,6 +57,17 @@ func (ts *Typings) Active(target, name string) {
 	}()
 }
 
+// Clear removes the typings of everyone on target, without emitting stops.
+func (ts *Typings) Clear(target string) {
+	ts.l.Lock()
+	for t := range ts.targets {
+		if t.Target == target {
+			delete(ts.targets, t)
+		}
+	}
+	ts.l.Unlock()
+}
+
 func (ts *Typings) Done(target, name string) {
 	ts.l.Lock()
 	delete(ts.targets, Typing{target, name})
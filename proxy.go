@@ -0,0 +1,283 @@
+package senpai
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// handshakeTimeout is how long proxies and WebSocket servers have to complete
+// their handshake, so that one that never answers doesn't hang the
+// connection.  It is a variable so that tests can shorten it.
+var handshakeTimeout = 30 * time.Second
+
+// dialer opens connections, directly or through a proxy.
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// newDialer returns a dialer that connects through the proxy at rawURL, or
+// directly if rawURL is empty.  Supported proxy URLs are
+// socks5://[user:password@]host:port and http://[user:password@]host:port.
+func newDialer(rawURL string) (d dialer, err error) {
+	if rawURL == "" {
+		return &net.Dialer{}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", rawURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", rawURL)
+	}
+
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+		d = &socks5Dialer{addr: host, username: username, password: password}
+	case "http":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8080")
+		}
+		d = &httpDialer{addr: host, username: username, password: password}
+	default:
+		err = fmt.Errorf("invalid proxy %q: unsupported scheme %q", rawURL, u.Scheme)
+	}
+	return
+}
+
+// socks5Dialer connects through a SOCKS5 proxy (RFC 1928), with an optional
+// username and password (RFC 1929).  Host names are resolved by the proxy.
+type socks5Dialer struct {
+	addr     string
+	username string
+	password string
+}
+
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPassAuth = 2
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (conn net.Conn, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if 255 < len(host) {
+		return nil, fmt.Errorf("host name %q is too long", host)
+	}
+
+	conn, err = net.Dial(network, d.addr)
+	if err != nil {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = d.handshake(conn, host, uint16(port))
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", d.addr, err)
+	}
+	return
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port uint16) (err error) {
+	method := byte(socks5NoAuth)
+	if d.username != "" {
+		method = socks5UserPassAuth
+	}
+	_, err = conn.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return
+	}
+
+	var buf [4]byte
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", buf[0])
+	}
+	if buf[1] == socks5NoAcceptable || buf[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == socks5UserPassAuth {
+		if 255 < len(d.username) || 255 < len(d.password) {
+			return errors.New("username or password is too long")
+		}
+		req := []byte{1, byte(len(d.username))}
+		req = append(req, d.username...)
+		req = append(req, byte(len(d.password)))
+		req = append(req, d.password...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return
+		}
+
+		_, err = io.ReadFull(conn, buf[:2])
+		if err != nil {
+			return
+		}
+		if buf[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	} else {
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return
+	}
+
+	_, err = io.ReadFull(conn, buf[:4])
+	if err != nil {
+		return
+	}
+	if buf[1] != 0 {
+		if int(buf[1]) < len(socks5Errors) {
+			return errors.New(socks5Errors[buf[1]])
+		}
+		return fmt.Errorf("unknown error %d", buf[1])
+	}
+
+	// Skip the address the proxy bound to.
+	var skip int
+	switch buf[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", buf[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return
+}
+
+// httpDialer connects through an HTTP proxy with the CONNECT method, with an
+// optional username and password.
+type httpDialer struct {
+	addr     string
+	username string
+	password string
+}
+
+func (d *httpDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	conn, err = net.Dial(network, d.addr)
+	if err != nil {
+		return
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %v", d.addr, err)
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %v", d.addr, err)
+	}
+	if res.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %s", d.addr, res.Status)
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %v", d.addr, err)
+	}
+
+	if 0 < r.Buffered() {
+		// The server spoke first, keep what has been read.
+		conn = &bufferedConn{Conn: conn, r: r}
+	}
+	return
+}
+
+// bufferedConn is a net.Conn whose first bytes have already been read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
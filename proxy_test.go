@@ -0,0 +1,165 @@
+package senpai
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveProxy accepts a single connection on a local listener, lets handshake
+// check the proxy request, then echoes everything back.
+func serveProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) error) (addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		if err := handshake(conn, r); err != nil {
+			t.Errorf("proxy: %v", err)
+			return
+		}
+		io.Copy(conn, r)
+	}()
+
+	return l.Addr().String()
+}
+
+func assertProxyEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("PING :proxy\r\n"))
+	if err != nil {
+		t.Fatalf("failed to write through the proxy: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read through the proxy: %v", err)
+	}
+	if line != "PING :proxy\r\n" {
+		t.Errorf("expected the proxy to echo %q, got %q", "PING :proxy\r\n", line)
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	addr := serveProxy(t, func(conn net.Conn, r *bufio.Reader) error {
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, []byte{5, 1, 2}) {
+			t.Errorf("expected username/password authentication, got %v", buf)
+		}
+		conn.Write([]byte{5, 2})
+
+		buf = make([]byte, 2+len("user")+1+len("pass"))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if string(buf) != "\x01\x04user\x04pass" {
+			t.Errorf("unexpected credentials %q", buf)
+		}
+		conn.Write([]byte{1, 0})
+
+		buf = make([]byte, 5+len("irc.example.org")+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if string(buf) != "\x05\x01\x00\x03\x0firc.example.org\x1a\x29" {
+			t.Errorf("unexpected request %q", buf)
+		}
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0x1a, 0x29})
+		return nil
+	})
+
+	d, err := newDialer("socks5://user:pass@" + addr)
+	if err != nil {
+		t.Fatalf("failed to create the dialer: %v", err)
+	}
+	conn, err := d.Dial("tcp", "irc.example.org:6697")
+	if err != nil {
+		t.Fatalf("failed to dial through the proxy: %v", err)
+	}
+	assertProxyEcho(t, conn)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	addr := serveProxy(t, func(conn net.Conn, r *bufio.Reader) error {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return err
+		}
+		if req.Method != http.MethodConnect || req.Host != "irc.example.org:6697" {
+			t.Errorf("unexpected request %s %s", req.Method, req.Host)
+		}
+		if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpwYXNz" {
+			t.Errorf("unexpected credentials %q", auth)
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	})
+
+	d, err := newDialer("http://user:pass@" + addr)
+	if err != nil {
+		t.Fatalf("failed to create the dialer: %v", err)
+	}
+	conn, err := d.Dial("tcp", "irc.example.org:6697")
+	if err != nil {
+		t.Fatalf("failed to dial through the proxy: %v", err)
+	}
+	assertProxyEcho(t, conn)
+}
+
+func TestProxyErrors(t *testing.T) {
+	for _, rawURL := range []string{"ftp://proxy", "socks5://", ":"} {
+		if _, err := newDialer(rawURL); err == nil {
+			t.Errorf("expected %q to be rejected", rawURL)
+		}
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		handshakeTimeout = timeout
+	}(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	for _, scheme := range []string{"socks5", "http"} {
+		// The proxy accepts the connection, but never answers.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}
+		}()
+
+		d, err := newDialer(scheme + "://" + l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to create the dialer: %v", err)
+		}
+		_, err = d.Dial("tcp", "irc.example.org:6667")
+		if err == nil {
+			t.Errorf("expected the %s proxy to time out", scheme)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package senpai
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// stsPolicy is the STS policy of a host: until Expires, it must only be
+// reached over TLS, on Port.
+type stsPolicy struct {
+	Port    int   `yaml:"port"`
+	Expires int64 `yaml:"expires"` // Unix time
+}
+
+// stsPolicies maps host names to their STS policy.  They are kept in a state
+// file, so that they outlive senpai.
+type stsPolicies struct {
+	path     string
+	policies map[string]stsPolicy
+}
+
+// stsPath returns the path of the state file of STS policies, in
+// $XDG_STATE_HOME, or ~/.local/state by default.
+func stsPath() (path string, err error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		var home string
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	path = filepath.Join(dir, "senpai", "sts.yaml")
+	return
+}
+
+// loadSTSPolicies reads the policies stored at path.  A missing file holds no
+// policy.
+func loadSTSPolicies(path string) (sts *stsPolicies, err error) {
+	sts = &stsPolicies{
+		path:     path,
+		policies: map[string]stsPolicy{},
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sts, nil
+	} else if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(buf, &sts.policies)
+	return
+}
+
+// Set stores the policy of host, or removes it if duration is zero, and saves
+// the state file.
+func (sts *stsPolicies) Set(host string, port int, duration time.Duration) error {
+	host = strings.ToLower(host)
+	if duration == 0 {
+		delete(sts.policies, host)
+	} else {
+		sts.policies[host] = stsPolicy{
+			Port:    port,
+			Expires: time.Now().Add(duration).Unix(),
+		}
+	}
+
+	buf, err := yaml.Marshal(sts.policies)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(sts.path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sts.path, buf, 0600)
+}
+
+// Upgrade returns srv, over TLS on the port of the policy of its host if it
+// would otherwise be reached in plaintext while the policy is valid.
+func (sts *stsPolicies) Upgrade(srv ServerConfig) (upgraded ServerConfig, ok bool) {
+	host := stsHost(srv)
+	if host == "" || srv.TLS == nil || *srv.TLS {
+		return srv, false
+	}
+
+	p, found := sts.policies[strings.ToLower(host)]
+	if !found || p.Expires < time.Now().Unix() {
+		return srv, false
+	}
+
+	// STS requires the certificate to be valid.
+	secure := true
+	srv.Addr = net.JoinHostPort(host, strconv.Itoa(p.Port))
+	srv.TLS = &secure
+	srv.TLSSkipVerify = false
+	return srv, true
+}
+
+// stsHost returns the host STS policies of srv are about, or "" if they don't
+// apply to it, e.g. for Unix domain sockets and WebSockets.
+func stsHost(srv ServerConfig) string {
+	if strings.Contains(srv.Addr, "://") {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(srv.Addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
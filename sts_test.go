@@ -0,0 +1,59 @@
+package senpai
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSTSPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "senpai")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "senpai", "sts.yaml")
+
+	sts, err := loadSTSPolicies(path)
+	if err != nil {
+		t.Fatalf("failed to load missing policies: %v", err)
+	}
+	err = sts.Set("IRC.example.org", 6697, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to save the policy: %v", err)
+	}
+	err = sts.Set("expired.example.org", 6697, -time.Minute)
+	if err != nil {
+		t.Fatalf("failed to save the policy: %v", err)
+	}
+
+	sts, err = loadSTSPolicies(path)
+	if err != nil {
+		t.Fatalf("failed to load the policies: %v", err)
+	}
+
+	plaintext := false
+	srv, ok := sts.Upgrade(ServerConfig{Addr: "irc.example.org:6667", TLS: &plaintext, TLSSkipVerify: true})
+	if !ok || srv.Addr != "irc.example.org:6697" || srv.TLS == nil || !*srv.TLS || srv.TLSSkipVerify {
+		t.Errorf("expected the connection to be upgraded to verified TLS on port 6697, got %#v", srv)
+	}
+	if _, ok := sts.Upgrade(ServerConfig{Addr: "irc.example.org:6697"}); ok {
+		t.Errorf("expected TLS connections to be left untouched")
+	}
+	if _, ok := sts.Upgrade(ServerConfig{Addr: "other.example.org:6667", TLS: &plaintext}); ok {
+		t.Errorf("expected hosts without policy to be left untouched")
+	}
+	if _, ok := sts.Upgrade(ServerConfig{Addr: "expired.example.org:6667", TLS: &plaintext}); ok {
+		t.Errorf("expected expired policies not to apply")
+	}
+
+	err = sts.Set("irc.example.org", 6697, 0)
+	if err != nil {
+		t.Fatalf("failed to remove the policy: %v", err)
+	}
+	if _, ok := sts.Upgrade(ServerConfig{Addr: "irc.example.org:6667", TLS: &plaintext}); ok {
+		t.Errorf("expected the removed policy not to apply")
+	}
+}
@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,6 +25,28 @@ type Line struct {
 	Highlight bool
 	Mergeable bool
 
+	// ID is the msgid of the message shown by the line, and ReplyTo the
+	// msgid of the message it replies to, if any.
+	ID      string
+	ReplyTo string
+
+	// Own is true if the message has been sent by the user.
+	Own bool
+
+	// Target is the channel or the user the message has been exchanged with,
+	// which differs from the buffer for queries shown in the home buffer.
+	Target string
+
+	// quote is the head and body of the line ReplyTo refers to, shown above
+	// the body, or "" if it is not in the buffer.
+	quote string
+
+	// reactions are shown below the body, in order of first appearance.
+	reactions []reaction
+
+	// notify is true if the line has been added as a highlight.
+	notify bool
+
 	splitPoints []point
 	width       int
 	newLines    []int
@@ -156,22 +179,165 @@ func (l *Line) NewLines(width int) []int {
 	return l.newLines
 }
 
+// reaction is a reaction to a message, and the users who reacted with it.
+type reaction struct {
+	Text  string
+	Users []string
+}
+
+// react adds the reaction of user, unless they already reacted the same way.
+func (l *Line) react(user, text string) {
+	for i := range l.reactions {
+		r := &l.reactions[i]
+		if r.Text != text {
+			continue
+		}
+		for _, u := range r.Users {
+			if u == user {
+				return
+			}
+		}
+		r.Users = append(r.Users, user)
+		return
+	}
+	l.reactions = append(l.reactions, reaction{
+		Text:  text,
+		Users: []string{user},
+	})
+}
+
+// reactionsString returns the reactions to the line and their counts, as
+// shown in the timeline.
+func (l *Line) reactionsString() string {
+	var sb strings.Builder
+	for i, r := range l.reactions {
+		if i != 0 {
+			sb.WriteString("  ")
+		}
+		sb.WriteString(r.Text)
+		if 1 < len(r.Users) {
+			sb.WriteRune(' ')
+			sb.WriteString(strconv.Itoa(len(r.Users)))
+		}
+	}
+	return sb.String()
+}
+
+// rows returns the number of rows the line takes in a timeline of the given
+// width.
+func (l *Line) rows(width int) int {
+	n := len(l.NewLines(width)) + 1
+	if l.quote != "" {
+		n++
+	}
+	if len(l.reactions) != 0 {
+		n++
+	}
+	return n
+}
+
+// splitLine splits a line whose body spans several rows (e.g. a multiline
+// message) into one line per row.  Only the first one keeps the head.
+func splitLine(line Line) (lines []Line) {
+	for i, body := range strings.Split(line.Body, "\n") {
+		l := line
+		l.Body = body
+		if i != 0 {
+			l.Head = ""
+		}
+		lines = append(lines, l)
+	}
+	return
+}
+
 type buffer struct {
+	// netID is the ID of the bouncer network the buffer belongs to, or "" for
+	// the main connection, and netName the name of the network.
+	netID   string
+	netName string
+
 	title      string
 	highlights int
 	unread     bool
 
 	lines []Line
 
+	// selected is the index of the line selected to be replied to, or -1.
+	selected int
+
+	// read is the time of the last message that has been read, on this
+	// client or another one.  separator is the time of the one after which
+	// the "new messages" separator is drawn, which is the read marker at the
+	// time the buffer has been switched to.
+	read      time.Time
+	separator time.Time
+
 	scrollAmt int
 	isAtTop   bool
 }
 
+// quoteLine computes the quote of the i-th line, from the line it replies to.
+// Lines that reply to another one always come after it, and only the first
+// line of a split message has a head.
+func (b *buffer) quoteLine(i int) {
+	l := &b.lines[i]
+	if l.ReplyTo == "" || l.quote != "" {
+		return
+	}
+	for j := i - 1; 0 <= j; j-- {
+		parent := &b.lines[j]
+		if parent.ID == l.ReplyTo && parent.Head != "" {
+			l.quote = parent.Head + ": " + parent.Body
+			return
+		}
+	}
+}
+
+// separatorAt returns whether the "new messages" separator is drawn above the
+// i-th line, that is if it is the first one after the read marker.
+func (b *buffer) separatorAt(i int) bool {
+	if b.separator.IsZero() || i == 0 {
+		return false
+	}
+	return b.lines[i].At.After(b.separator) && !b.lines[i-1].At.After(b.separator)
+}
+
+// lineRows returns the number of rows taken by the i-th line, including the
+// separator above it.
+func (b *buffer) lineRows(i, width int) int {
+	n := b.lines[i].rows(width)
+	if b.separatorAt(i) {
+		n++
+	}
+	return n
+}
+
+// rowsFrom returns the number of rows taken by the lines starting at the
+// i-th one, up to the end of the buffer.
+func (b *buffer) rowsFrom(i, width int) (rows int) {
+	for ; i < len(b.lines); i++ {
+		rows += b.lineRows(i, width)
+	}
+	return
+}
+
+// Contact is a user whose presence is shown in the buffer list.
+type Contact struct {
+	Name   string
+	Online bool
+
+	netID string
+}
+
 type BufferList struct {
 	list    []buffer
 	current int
 	clicked int
 
+	// contacts are shown next to the buffer of the same name and network, or
+	// below the buffers if there is none.
+	contacts []Contact
+
 	tlWidth      int
 	tlHeight     int
 	nickColWidth int
@@ -202,53 +368,118 @@ func (bs *BufferList) To(i int) {
 		if len(bs.list) <= bs.current {
 			bs.current = len(bs.list) - 1
 		}
-		bs.list[bs.current].highlights = 0
-		bs.list[bs.current].unread = false
+		bs.visit()
 	}
 }
 
 func (bs *BufferList) Next() {
 	bs.current = (bs.current + 1) % len(bs.list)
-	bs.list[bs.current].highlights = 0
-	bs.list[bs.current].unread = false
+	bs.visit()
 }
 
 func (bs *BufferList) Previous() {
 	bs.current = (bs.current - 1 + len(bs.list)) % len(bs.list)
-	bs.list[bs.current].highlights = 0
-	bs.list[bs.current].unread = false
+	bs.visit()
 }
 
-func (bs *BufferList) Add(title string) (ok bool) {
-	lTitle := strings.ToLower(title)
-	for _, b := range bs.list {
-		if strings.ToLower(b.title) == lTitle {
-			return
+// visit marks the current buffer as seen, and moves its separator to its read
+// marker.
+func (bs *BufferList) visit() {
+	b := &bs.list[bs.current]
+	b.highlights = 0
+	b.unread = false
+	b.separator = b.read
+}
+
+// Add adds a buffer after the other buffers of the same network.  The first
+// buffer of a bouncer network is shown with the name of the network, and the
+// next ones below it.
+func (bs *BufferList) Add(netID, netName, title string) (ok bool) {
+	if 0 <= bs.idx(netID, title) {
+		return
+	}
+
+	i := len(bs.list)
+	for j, b := range bs.list {
+		if b.netID == netID {
+			i = j + 1
 		}
 	}
 
 	ok = true
-	bs.list = append(bs.list, buffer{title: title})
+	bs.list = append(bs.list, buffer{})
+	copy(bs.list[i+1:], bs.list[i:])
+	bs.list[i] = buffer{
+		netID:    netID,
+		netName:  netName,
+		title:    title,
+		selected: -1,
+	}
+	if 1 < len(bs.list) && i <= bs.current {
+		bs.current++
+	}
 	return
 }
 
-func (bs *BufferList) Remove(title string) (ok bool) {
-	lTitle := strings.ToLower(title)
+// Rename changes the title of a buffer, which keeps its lines and where it is
+// scrolled to.
+func (bs *BufferList) Rename(netID, title, newTitle string) (ok bool) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return
+	}
+	bs.list[idx].title = newTitle
+	return true
+}
+
+func (bs *BufferList) Remove(netID, title string) (ok bool) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return
+	}
+	ok = true
+	bs.list = append(bs.list[:idx], bs.list[idx+1:]...)
+	if idx < bs.current || len(bs.list) <= bs.current {
+		bs.current--
+	}
+	return
+}
+
+// RemoveNetwork removes all the buffers of a bouncer network.
+func (bs *BufferList) RemoveNetwork(netID string) {
+	list := bs.list[:0]
+	current := 0
 	for i, b := range bs.list {
-		if strings.ToLower(b.title) == lTitle {
-			ok = true
-			bs.list = append(bs.list[:i], bs.list[i+1:]...)
-			if len(bs.list) <= bs.current {
-				bs.current--
-			}
-			return
+		if b.netID == netID {
+			continue
+		}
+		if i <= bs.current {
+			current = len(list)
+		}
+		list = append(list, b)
+	}
+	bs.list = list
+	bs.current = current
+}
+
+// SetNetworkName changes the name shown for the buffers of a bouncer network.
+func (bs *BufferList) SetNetworkName(netID, netName string) {
+	for i := range bs.list {
+		if bs.list[i].netID == netID {
+			bs.list[i].netName = netName
 		}
 	}
-	return
 }
 
-func (bs *BufferList) AddLine(title string, highlight bool, line Line) {
-	idx := bs.idx(title)
+func (bs *BufferList) AddLine(netID, title string, highlight bool, line Line) {
+	if strings.ContainsRune(line.Body, '\n') {
+		for i, l := range splitLine(line) {
+			bs.AddLine(netID, title, highlight && i == 0, l)
+		}
+		return
+	}
+
+	idx := bs.idx(netID, title)
 	if idx < 0 {
 		return
 	}
@@ -257,6 +488,7 @@ func (bs *BufferList) AddLine(title string, highlight bool, line Line) {
 	n := len(b.lines)
 	line.Body = strings.TrimRight(line.Body, "\t ")
 	line.At = line.At.UTC()
+	line.notify = highlight
 
 	if line.Mergeable && n != 0 && b.lines[n-1].Mergeable {
 		l := &b.lines[n-1]
@@ -266,12 +498,13 @@ func (bs *BufferList) AddLine(title string, highlight bool, line Line) {
 	} else {
 		line.computeSplitPoints()
 		b.lines = append(b.lines, line)
+		b.quoteLine(n)
 		if idx == bs.current && 0 < b.scrollAmt {
-			b.scrollAmt += len(line.NewLines(bs.tlInnerWidth())) + 1
+			b.scrollAmt += b.lineRows(n, bs.tlInnerWidth())
 		}
 	}
 
-	if !line.Mergeable && idx != bs.current {
+	if !line.Mergeable && idx != bs.current && line.At.After(b.read) {
 		b.unread = true
 	}
 	if highlight && idx != bs.current {
@@ -279,13 +512,23 @@ func (bs *BufferList) AddLine(title string, highlight bool, line Line) {
 	}
 }
 
-func (bs *BufferList) AddLines(title string, lines []Line) {
-	idx := bs.idx(title)
+func (bs *BufferList) AddLines(netID, title string, lines []Line) {
+	idx := bs.idx(netID, title)
 	if idx < 0 {
 		return
 	}
 
 	b := &bs.list[idx]
+
+	var split []Line
+	for _, l := range lines {
+		if strings.ContainsRune(l.Body, '\n') {
+			split = append(split, splitLine(l)...)
+		} else {
+			split = append(split, l)
+		}
+	}
+	lines = split
 	limit := len(lines)
 
 	if 0 < len(b.lines) {
@@ -301,11 +544,154 @@ func (bs *BufferList) AddLines(title string, lines []Line) {
 		lines[i].computeSplitPoints()
 	}
 
+	if idx != bs.current && !b.read.IsZero() {
+		for _, l := range lines[:limit] {
+			if !l.Mergeable && l.At.After(b.read) {
+				b.unread = true
+			}
+		}
+	}
+
 	b.lines = append(lines[:limit], b.lines...)
+	if 0 <= b.selected {
+		b.selected += limit
+	}
+
+	// Only the added lines, and the replies to them that were already there,
+	// may have a new quote.
+	added := make(map[string]struct{}, limit)
+	for _, l := range b.lines[:limit] {
+		if l.ID != "" {
+			added[l.ID] = struct{}{}
+		}
+	}
+	for i := range b.lines {
+		if i < limit {
+			b.quoteLine(i)
+		} else if _, ok := added[b.lines[i].ReplyTo]; ok {
+			b.quoteLine(i)
+		}
+	}
 }
 
-func (bs *BufferList) Current() (title string) {
-	return bs.list[bs.current].title
+// AddReaction adds the reaction of user to the message whose msgid is msgID.
+// Reactions to messages that are not in the buffer are dropped.
+func (bs *BufferList) AddReaction(netID, title, msgID, user, text string) {
+	idx := bs.idx(netID, title)
+	if idx < 0 || msgID == "" {
+		return
+	}
+
+	b := &bs.list[idx]
+	// Reactions go below the last line of split messages.
+	for i := len(b.lines) - 1; 0 <= i; i-- {
+		if b.lines[i].ID == msgID {
+			b.lines[i].react(user, text)
+			return
+		}
+	}
+}
+
+// Redact replaces the body of the message whose msgid is msgID with body, and
+// drops its reactions.  Split messages are merged back into a single line.
+func (bs *BufferList) Redact(netID, title, msgID, body string) {
+	idx := bs.idx(netID, title)
+	if idx < 0 || msgID == "" {
+		return
+	}
+
+	b := &bs.list[idx]
+	found := false
+	selected := -1
+	lines := b.lines[:0]
+	for i, l := range b.lines {
+		if l.ID == msgID {
+			if found {
+				continue
+			}
+			found = true
+			l.Body = body
+			l.reactions = nil
+			l.computeSplitPoints()
+			l.width = 0
+		}
+		if i == b.selected {
+			selected = len(lines)
+		}
+		lines = append(lines, l)
+	}
+	b.lines = lines
+	b.selected = selected
+	if !found {
+		return
+	}
+
+	for i := range b.lines {
+		if b.lines[i].ReplyTo == msgID {
+			b.lines[i].quote = ""
+			b.quoteLine(i)
+		}
+	}
+}
+
+// SetRead moves the read marker of the given buffer to t, as another client
+// may have done.  If the buffer is not the current one, whether it is unread
+// and its highlights are updated to the lines that come after the marker.
+func (bs *BufferList) SetRead(netID, title string, t time.Time) {
+	idx := bs.idx(netID, title)
+	if idx < 0 {
+		return
+	}
+
+	b := &bs.list[idx]
+	t = t.UTC()
+	if !t.After(b.read) {
+		return
+	}
+	b.read = t
+
+	if idx == bs.current {
+		if b.separator.IsZero() {
+			b.separator = t
+		}
+		return
+	}
+
+	b.separator = t
+	b.unread = false
+	b.highlights = 0
+	for _, l := range b.lines {
+		if !l.At.After(t) {
+			continue
+		}
+		if !l.Mergeable {
+			b.unread = true
+		}
+		if l.notify {
+			b.highlights++
+		}
+	}
+}
+
+// MarkCurrentRead moves the read marker of the current buffer to its last
+// line, and returns its time if the marker has moved.  It doesn't move while
+// the timeline is scrolled up, since the last line is not shown then.
+func (bs *BufferList) MarkCurrentRead() (t time.Time, ok bool) {
+	b := &bs.list[bs.current]
+	if len(b.lines) == 0 || 0 < b.scrollAmt {
+		return
+	}
+	t = b.lines[len(b.lines)-1].At
+	if !t.After(b.read) {
+		return
+	}
+	b.read = t
+	return t, true
+}
+
+func (bs *BufferList) Current() (netID, title string) {
+	b := &bs.list[bs.current]
+	return b.netID, b.title
 }
 
 func (bs *BufferList) CurrentOldestTime() (t *time.Time) {
@@ -333,25 +719,123 @@ func (bs *BufferList) ScrollDown(n int) {
 	}
 }
 
-func (bs *BufferList) IsAtTop() bool {
+// SelectPrevious selects the message above the selected one in the current
+// buffer, or the last message if none is selected.  Only messages with a
+// msgid can be selected.
+func (bs *BufferList) SelectPrevious() {
 	b := &bs.list[bs.current]
-	return b.isAtTop
+	i := b.selected
+	if i < 0 {
+		i = len(b.lines)
+	}
+	for i--; 0 <= i; i-- {
+		l := &b.lines[i]
+		if l.ID != "" && l.Head != "" {
+			bs.selectLine(i)
+			return
+		}
+	}
+}
+
+// SelectNext selects the message below the selected one in the current
+// buffer, or clears the selection if it was the last one.
+func (bs *BufferList) SelectNext() {
+	b := &bs.list[bs.current]
+	if b.selected < 0 {
+		return
+	}
+	for i := b.selected + 1; i < len(b.lines); i++ {
+		l := &b.lines[i]
+		if l.ID != "" && l.Head != "" {
+			bs.selectLine(i)
+			return
+		}
+	}
+	b.selected = -1
 }
 
-func (bs *BufferList) idx(title string) int {
-	if title == "" {
-		return bs.current
+// selectLine selects the i-th line of the current buffer, and scrolls the
+// timeline so that it is visible.
+func (bs *BufferList) selectLine(i int) {
+	b := &bs.list[bs.current]
+	b.selected = i
+
+	width := bs.tlInnerWidth()
+	top := b.rowsFrom(i, width)
+	bottom := top - b.lineRows(i, width)
+	if b.scrollAmt+bs.tlHeight < top {
+		b.scrollAmt = top - bs.tlHeight
+	} else if bottom < b.scrollAmt {
+		b.scrollAmt = bottom
 	}
+}
+
+func (bs *BufferList) ClearSelection() {
+	bs.list[bs.current].selected = -1
+}
 
+// Selected returns the selected line of the current buffer, if any.
+func (bs *BufferList) Selected() (line Line, ok bool) {
+	b := &bs.list[bs.current]
+	if b.selected < 0 {
+		return
+	}
+	return b.lines[b.selected], true
+}
+
+func (bs *BufferList) IsAtTop() bool {
+	b := &bs.list[bs.current]
+	return b.isAtTop
+}
+
+func (bs *BufferList) idx(netID, title string) int {
 	lTitle := strings.ToLower(title)
 	for i, b := range bs.list {
-		if strings.ToLower(b.title) == lTitle {
+		if b.netID == netID && strings.ToLower(b.title) == lTitle {
 			return i
 		}
 	}
 	return -1
 }
 
+// SetContacts replaces the contacts of the given network.
+func (bs *BufferList) SetContacts(netID string, contacts []Contact) {
+	list := bs.contacts[:0]
+	for _, c := range bs.contacts {
+		if c.netID != netID {
+			list = append(list, c)
+		}
+	}
+	for _, c := range contacts {
+		c.netID = netID
+		list = append(list, c)
+	}
+	bs.contacts = list
+}
+
+// contact returns the contact of the given network whose name is title, if
+// any.
+func (bs *BufferList) contact(netID, title string) (c Contact, ok bool) {
+	lTitle := strings.ToLower(title)
+	for _, c := range bs.contacts {
+		if c.netID == netID && strings.ToLower(c.Name) == lTitle {
+			return c, true
+		}
+	}
+	return
+}
+
+// drawPresence draws whether a contact is online, as a green or dimmed dot.
+func drawPresence(screen tcell.Screen, x, y int, c Contact) {
+	st := tcell.StyleDefault.Dim(true)
+	r := '\u25cb'
+	if c.Online {
+		st = tcell.StyleDefault.Foreground(tcell.ColorGreen)
+		r = '\u25cf'
+	}
+	screen.SetContent(x, y, r, nil, st)
+}
+
 func (bs *BufferList) DrawVerticalBufferList(screen tcell.Screen, x0, y0, width, height int) {
 	width--
 	st := tcell.StyleDefault
@@ -375,7 +859,19 @@ func (bs *BufferList) DrawVerticalBufferList(screen tcell.Screen, x0, y0, width,
 		if i == bs.clicked {
 			st = st.Reverse(true).Dim(true)
 		}
-		title := truncate(b.title, width, "\u2026")
+		title := b.title
+		if b.netName != "" {
+			if i == 0 || bs.list[i-1].netID != b.netID {
+				title = b.netName
+			} else {
+				x += 2
+			}
+		}
+		if c, ok := bs.contact(b.netID, b.title); ok {
+			drawPresence(screen, x, y, c)
+			x += 2
+		}
+		title = truncate(title, x0+width-x, "\u2026")
 		printString(screen, &x, y, st, title)
 		if 0 < b.highlights {
 			st = st.Foreground(tcell.ColorRed).Reverse(true)
@@ -394,6 +890,21 @@ func (bs *BufferList) DrawVerticalBufferList(screen tcell.Screen, x0, y0, width,
 		}
 		y++
 	}
+
+	y := y0 + len(bs.list) + 1
+	for _, c := range bs.contacts {
+		if 0 <= bs.idx(c.netID, c.Name) {
+			continue
+		}
+		if y0+height <= y {
+			break
+		}
+		x := x0
+		drawPresence(screen, x, y, c)
+		x += 2
+		printString(screen, &x, y, tcell.StyleDefault, truncate(c.Name, x0+width-x, "\u2026"))
+		y++
+	}
 }
 
 func (bs *BufferList) DrawTimeline(screen tcell.Screen, x0, y0, nickColWidth int) {
@@ -415,20 +926,30 @@ func (bs *BufferList) DrawTimeline(screen tcell.Screen, x0, y0, nickColWidth int
 
 		line := &b.lines[i]
 		nls := line.NewLines(bs.tlInnerWidth())
-		yi -= len(nls) + 1
+		yi -= b.lineRows(i, bs.tlInnerWidth())
 		if y0+bs.tlHeight <= yi {
 			continue
 		}
 
+		y := yi
+		if b.separatorAt(i) {
+			drawSeparator(screen, x0, y, bs.tlWidth)
+			y++
+		}
+
 		if i == 0 || b.lines[i-1].At.Truncate(time.Minute) != line.At.Truncate(time.Minute) {
-			printTime(screen, x0, yi, st.Bold(true), line.At.Local())
+			printTime(screen, x0, y, st.Bold(true), line.At.Local())
 		}
 
-		identSt := st.Foreground(colorFromCode(line.HeadColor)).Reverse(line.Highlight)
-		printIdent(screen, x0+7, yi, nickColWidth, identSt, line.Head)
+		identSt := st.Foreground(colorFromCode(line.HeadColor)).Reverse(line.Highlight != (i == b.selected))
+		printIdent(screen, x0+7, y, nickColWidth, identSt, line.Head)
 
+		if line.quote != "" {
+			drawQuote(screen, x1, y, bs.tlInnerWidth(), line.quote)
+			y++
+		}
 		x := x1
-		y := yi
+		yb := y // the first row of the body
 
 		var sb StyleBuffer
 		sb.Reset()
@@ -442,7 +963,7 @@ func (bs *BufferList) DrawTimeline(screen tcell.Screen, x0, y0, nickColWidth int
 				}
 			}
 
-			if y != yi && x == x1 && IsSplitRune(r) {
+			if y != yb && x == x1 && IsSplitRune(r) {
 				continue
 			}
 
@@ -457,11 +978,51 @@ func (bs *BufferList) DrawTimeline(screen tcell.Screen, x0, y0, nickColWidth int
 		}
 
 		sb.Reset()
+
+		if len(line.reactions) != 0 {
+			x := x1
+			printString(screen, &x, y+1, st, truncate(line.reactionsString(), bs.tlInnerWidth(), "\u2026"))
+		}
 	}
 
 	b.isAtTop = y0 <= yi
 }
 
+// drawSeparator draws the line above the first message that hasn't been read.
+func drawSeparator(screen tcell.Screen, x0, y, width int) {
+	st := tcell.StyleDefault.Foreground(tcell.ColorRed)
+	for x := x0; x < x0+width; x++ {
+		screen.SetContent(x, y, 0x2500, nil, st)
+	}
+	x := x0 + 2
+	printString(screen, &x, y, st, " new messages ")
+}
+
+// drawQuote draws, dimmed and on a single row, the message a line replies to.
+func drawQuote(screen tcell.Screen, x0, y, width int, quote string) {
+	st := tcell.StyleDefault.Dim(true)
+	x := x0
+	printString(screen, &x, y, st, "\u21b1 ")
+
+	var sb StyleBuffer
+	sb.Reset()
+	for _, r := range quote {
+		if x0+width-1 <= x {
+			screen.SetContent(x, y, '\u2026', nil, st)
+			return
+		}
+		if rst, ok := sb.WriteRune(r); ok != 0 {
+			rst = rst.Dim(true)
+			if 1 < ok {
+				screen.SetContent(x, y, ',', nil, rst)
+				x++
+			}
+			screen.SetContent(x, y, r, nil, rst)
+			x += runeWidth(r)
+		}
+	}
+}
+
 func IrcColorCode(code int) string {
 	var c [3]rune
 	c[0] = 0x03
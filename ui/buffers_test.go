@@ -3,10 +3,11 @@ package ui
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func assertSplitPoints(t *testing.T, body string, expected []point) {
-	l := Line{body: body}
+	l := Line{Body: body}
 	l.computeSplitPoints()
 
 	if len(l.splitPoints) != len(expected) {
@@ -71,7 +72,7 @@ func showSplit(s string, nls []int) string {
 }
 
 func assertNewLines(t *testing.T, body string, width int, expected int) {
-	l := Line{body: body}
+	l := Line{Body: body}
 	l.computeSplitPoints()
 
 	actual := l.NewLines(width)
@@ -174,3 +175,240 @@ func TestTrimWidth(t *testing.T) {
 	assertTrimWidth(t, "zzzzzzzzzzzzzz黒猫/sr", 16, "zzzzzzzzzzzzzz黒…")
 }
 // */
+
+func TestReplyQuote(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "#senpai")
+
+	bs.AddLine("", "#senpai", false, Line{Head: "alice", Body: "hello", ID: "abc"})
+	bs.AddLine("", "#senpai", false, Line{Head: "senpai", Body: "hi", ID: "def", ReplyTo: "abc"})
+	bs.AddLine("", "#senpai", false, Line{Head: "bob", Body: "?", ID: "ghi", ReplyTo: "xyz"})
+
+	lines := bs.list[0].lines
+	if lines[1].quote != "alice: hello" {
+		t.Errorf("expected the reply to quote %q, got %q", "alice: hello", lines[1].quote)
+	}
+	if lines[1].rows(40) != 2 {
+		t.Errorf("expected the reply to take 2 rows, got %d", lines[1].rows(40))
+	}
+	if lines[2].quote != "" {
+		t.Errorf("expected no quote for a missing message, got %q", lines[2].quote)
+	}
+
+	// The parent of the last reply comes with the history.
+	bs.AddLines("", "#senpai", []Line{
+		{Head: "carol", Body: "old", ID: "xyz"},
+		{Head: "dave", Body: "older?", ID: "uvw", ReplyTo: "xyz"},
+	})
+	lines = bs.list[0].lines
+	if lines[1].quote != "carol: old" {
+		t.Errorf("expected the history to quote itself, got %q", lines[1].quote)
+	}
+	if lines[4].quote != "carol: old" {
+		t.Errorf("expected the reply to quote the history, got %q", lines[4].quote)
+	}
+}
+
+func TestSelection(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "#senpai")
+
+	bs.AddLine("", "#senpai", false, Line{Head: "alice", Body: "hello", ID: "abc"})
+	bs.AddLine("", "#senpai", false, Line{Head: "--", Body: "+bob", Mergeable: true})
+	bs.AddLine("", "#senpai", false, Line{Head: "bob", Body: "a\nb", ID: "def"})
+
+	if _, ok := bs.Selected(); ok {
+		t.Fatalf("expected nothing to be selected")
+	}
+	bs.SelectPrevious()
+	if l, ok := bs.Selected(); !ok || l.ID != "def" || l.Body != "a" {
+		t.Errorf("expected the first line of the last message to be selected, got %#v", l)
+	}
+	bs.SelectPrevious()
+	if l, ok := bs.Selected(); !ok || l.ID != "abc" {
+		t.Errorf("expected the first message to be selected, got %#v", l)
+	}
+	bs.SelectPrevious()
+	if l, ok := bs.Selected(); !ok || l.ID != "abc" {
+		t.Errorf("expected the selection to stay on the first message, got %#v", l)
+	}
+
+	bs.AddLines("", "#senpai", []Line{{Head: "carol", Body: "old", ID: "xyz"}})
+	if l, ok := bs.Selected(); !ok || l.ID != "abc" {
+		t.Errorf("expected the selection to follow the history, got %#v", l)
+	}
+
+	bs.SelectNext()
+	bs.SelectNext()
+	if _, ok := bs.Selected(); ok {
+		t.Errorf("expected the selection to be cleared past the last message")
+	}
+}
+
+func TestReactions(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "#senpai")
+
+	bs.AddLine("", "#senpai", false, Line{Head: "alice", Body: "hello\nworld", ID: "abc"})
+	bs.AddReaction("", "#senpai", "abc", "bob", "+1")
+	bs.AddReaction("", "#senpai", "abc", "carol", "+1")
+	bs.AddReaction("", "#senpai", "abc", "carol", "+1")
+	bs.AddReaction("", "#senpai", "abc", "bob", "tada")
+	bs.AddReaction("", "#senpai", "xyz", "bob", "tada")
+
+	lines := bs.list[0].lines
+	if len(lines[0].reactions) != 0 {
+		t.Errorf("expected reactions to go below the last line of the message")
+	}
+	if s := lines[1].reactionsString(); s != "+1 2  tada" {
+		t.Errorf("expected reactions %q, got %q", "+1 2  tada", s)
+	}
+	if lines[1].rows(40) != 2 {
+		t.Errorf("expected the reactions to take a row, got %d rows", lines[1].rows(40))
+	}
+}
+
+func TestRedact(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "#senpai")
+
+	bs.AddLine("", "#senpai", false, Line{Head: "alice", Body: "hello\nworld", ID: "abc"})
+	bs.AddLine("", "#senpai", false, Line{Head: "bob", Body: "hi", ID: "def", ReplyTo: "abc"})
+	bs.AddReaction("", "#senpai", "abc", "bob", "+1")
+	bs.SelectPrevious()
+
+	bs.Redact("", "#senpai", "abc", "(message deleted)")
+
+	lines := bs.list[0].lines
+	if len(lines) != 2 {
+		t.Fatalf("expected the split message to be merged, got %d lines", len(lines))
+	}
+	if lines[0].Body != "(message deleted)" || len(lines[0].reactions) != 0 {
+		t.Errorf("expected the message to be replaced, got %#v", lines[0])
+	}
+	if lines[1].quote != "alice: (message deleted)" {
+		t.Errorf("expected the quote of the reply to be updated, got %q", lines[1].quote)
+	}
+	if l, ok := bs.Selected(); !ok || l.ID != "def" {
+		t.Errorf("expected the selection to follow the lines, got %#v", l)
+	}
+}
+
+func TestReadMarker(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "home")
+	bs.Add("", "", "#senpai")
+
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	bs.AddLine("", "#senpai", false, Line{At: at, Head: "alice", Body: "hello"})
+	bs.AddLine("", "#senpai", true, Line{At: at.Add(time.Minute), Head: "bob", Body: "senpai?"})
+	bs.AddLine("", "#senpai", false, Line{At: at.Add(2 * time.Minute), Head: "alice", Body: "bye"})
+
+	b := &bs.list[1]
+	if !b.unread || b.highlights != 1 {
+		t.Fatalf("expected the buffer to be unread with a highlight")
+	}
+
+	// Another client read up to the highlight.
+	bs.SetRead("", "#senpai", at.Add(time.Minute))
+	if !b.unread || b.highlights != 0 {
+		t.Errorf("expected the buffer to be unread without highlights, got %t and %d", b.unread, b.highlights)
+	}
+	bs.SetRead("", "#senpai", at)
+	if !b.read.Equal(at.Add(time.Minute)) {
+		t.Errorf("expected the read marker not to go backwards")
+	}
+
+	bs.Next()
+	if b.separatorAt(1) || !b.separatorAt(2) {
+		t.Errorf("expected the separator to be above the last line")
+	}
+	if b.lineRows(2, 40) != 2 {
+		t.Errorf("expected the separator to take a row")
+	}
+	bs.ScrollUp(2)
+	if _, ok := bs.MarkCurrentRead(); ok {
+		t.Errorf("expected the read marker not to move while scrolled up")
+	}
+	bs.ScrollDown(2)
+	if read, ok := bs.MarkCurrentRead(); !ok || !read.Equal(at.Add(2*time.Minute)) {
+		t.Errorf("expected the buffer to be read up to its last line, got %s", read)
+	}
+	if _, ok := bs.MarkCurrentRead(); ok {
+		t.Errorf("expected the read marker not to move twice")
+	}
+	if !b.separatorAt(2) {
+		t.Errorf("expected the separator to stay until the buffer is switched to again")
+	}
+
+	bs.SetRead("", "#senpai", at.Add(3*time.Minute))
+	bs.AddLine("", "#senpai", false, Line{At: at.Add(4 * time.Minute), Head: "alice", Body: "hi"})
+	bs.Previous()
+	bs.AddLines("", "#senpai", []Line{{At: at.Add(-time.Minute), Head: "carol", Body: "old"}})
+	if b.unread {
+		t.Errorf("expected messages before the read marker to be read")
+	}
+}
+
+func TestRename(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "home")
+	bs.Add("", "", "#senpai")
+	bs.Next()
+
+	bs.AddLine("", "#senpai", false, Line{Head: "alice", Body: "hello"})
+	bs.ScrollUp(3)
+
+	if !bs.Rename("", "#SENPAI", "#senpai-dev") {
+		t.Fatalf("expected the buffer to be renamed")
+	}
+	if _, title := bs.Current(); title != "#senpai-dev" {
+		t.Errorf("expected the current buffer to be renamed, got %q", title)
+	}
+	b := &bs.list[1]
+	if len(b.lines) != 1 || b.scrollAmt != 3 {
+		t.Errorf("expected the buffer to keep its lines and scroll, got %d lines and %d rows", len(b.lines), b.scrollAmt)
+	}
+	if bs.Rename("", "#senpai", "#other") {
+		t.Errorf("expected the former title not to match anymore")
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	bs := NewBufferList(80, 10, 16)
+	bs.Add("", "", "home")
+	bs.Add("1", "libera", "home")
+	bs.Add("2", "oftc", "home")
+	bs.Add("1", "libera", "#senpai")
+	bs.Add("2", "oftc", "#senpai")
+	bs.To(4)
+
+	var titles []string
+	for _, b := range bs.list {
+		titles = append(titles, b.netID+"/"+b.title)
+	}
+	if s := strings.Join(titles, " "); s != "/home 1/home 1/#senpai 2/home 2/#senpai" {
+		t.Errorf("expected buffers to be grouped by network, got %q", s)
+	}
+	if netID, title := bs.Current(); netID != "2" || title != "#senpai" {
+		t.Errorf("expected the current buffer to stay the same, got %q %q", netID, title)
+	}
+
+	bs.AddLine("1", "#senpai", false, Line{Head: "alice", Body: "hello"})
+	if len(bs.list[2].lines) != 1 || len(bs.list[4].lines) != 0 {
+		t.Errorf("expected the line to be added to the buffer of the network")
+	}
+
+	bs.SetNetworkName("1", "libera.chat")
+	if bs.list[1].netName != "libera.chat" || bs.list[2].netName != "libera.chat" {
+		t.Errorf("expected the network to be renamed")
+	}
+
+	bs.RemoveNetwork("1")
+	if len(bs.list) != 3 {
+		t.Fatalf("expected the buffers of the network to be removed, got %d buffers", len(bs.list))
+	}
+	if netID, title := bs.Current(); netID != "2" || title != "#senpai" {
+		t.Errorf("expected the current buffer to stay the same, got %q %q", netID, title)
+	}
+}
@@ -59,6 +59,10 @@ func (e *Editor) IsCommand() bool {
 	return len(e.text[e.lineIdx]) != 0 && e.text[e.lineIdx][0] == '/'
 }
 
+func (e *Editor) Content() string {
+	return string(e.text[e.lineIdx])
+}
+
 func (e *Editor) TextLen() int {
 	return len(e.text[e.lineIdx])
 }
@@ -74,7 +78,7 @@ func (e *Editor) putRune(r rune) {
 	copy(e.text[e.lineIdx][e.cursorIdx+1:], e.text[e.lineIdx][e.cursorIdx:])
 	e.text[e.lineIdx][e.cursorIdx] = r
 
-	rw := runeWidth(r)
+	rw := editorRuneWidth(r)
 	tw := e.textWidth[len(e.textWidth)-1]
 	e.textWidth = append(e.textWidth, tw+rw)
 	for i := e.cursorIdx + 1; i < len(e.textWidth); i++ {
@@ -237,11 +241,20 @@ func (e *Editor) computeTextWidth() {
 	e.textWidth = e.textWidth[:1]
 	rw := 0
 	for _, r := range e.text[e.lineIdx] {
-		rw += runeWidth(r)
+		rw += editorRuneWidth(r)
 		e.textWidth = append(e.textWidth, rw)
 	}
 }
 
+// editorRuneWidth is like runeWidth, except that line feeds, which are drawn
+// as "↲", occupy one cell.
+func editorRuneWidth(r rune) int {
+	if r == '\n' {
+		return 1
+	}
+	return runeWidth(r)
+}
+
 func (e *Editor) Draw(screen tcell.Screen, x0, y int) {
 	st := tcell.StyleDefault
 
@@ -250,8 +263,12 @@ func (e *Editor) Draw(screen tcell.Screen, x0, y int) {
 
 	for i < len(e.text[e.lineIdx]) && x < x0+e.width {
 		r := e.text[e.lineIdx][i]
-		screen.SetContent(x, y, r, nil, st)
-		x += runeWidth(r)
+		if r == '\n' {
+			screen.SetContent(x, y, 0x21B2, nil, st.Dim(true))
+		} else {
+			screen.SetContent(x, y, r, nil, st)
+		}
+		x += editorRuneWidth(r)
 		i++
 	}
 
@@ -2,21 +2,24 @@ package ui
 
 import "testing"
 
-var hell editor = editor{
-	text:      []rune{'h', 'e', 'l', 'l'},
+var hell Editor = Editor{
+	text:      [][]rune{{'h', 'e', 'l', 'l'}},
 	textWidth: []int{0, 1, 2, 3, 4},
 	cursorIdx: 4,
 	offsetIdx: 0,
 	width:     5,
 }
 
-func assertEditorEq(t *testing.T, actual, expected editor) {
-	if len(actual.text) != len(expected.text) {
-		t.Errorf("expected text len to be %d, got %d\n", len(expected.text), len(actual.text))
+func assertEditorEq(t *testing.T, actual, expected Editor) {
+	actualText := actual.text[actual.lineIdx]
+	expectedText := expected.text[expected.lineIdx]
+
+	if len(actualText) != len(expectedText) {
+		t.Errorf("expected text len to be %d, got %d\n", len(expectedText), len(actualText))
 	} else {
-		for i := 0; i < len(actual.text); i++ {
-			a := actual.text[i]
-			e := expected.text[i]
+		for i := 0; i < len(actualText); i++ {
+			a := actualText[i]
+			e := expectedText[i]
 
 			if a != e {
 				t.Errorf("expected rune #%d to be '%c', got '%c'\n", i, e, a)
@@ -51,10 +54,10 @@ func assertEditorEq(t *testing.T, actual, expected editor) {
 }
 
 func TestOneLetter(t *testing.T) {
-	e := newEditor(5)
+	e := NewEditor(5, nil)
 	e.PutRune('h')
-	assertEditorEq(t, e, editor{
-		text:      []rune{'h'},
+	assertEditorEq(t, e, Editor{
+		text:      [][]rune{{'h'}},
 		textWidth: []int{0, 1},
 		cursorIdx: 1,
 		offsetIdx: 0,
@@ -63,7 +66,7 @@ func TestOneLetter(t *testing.T) {
 }
 
 func TestFourLetters(t *testing.T) {
-	e := newEditor(5)
+	e := NewEditor(5, nil)
 	e.PutRune('h')
 	e.PutRune('e')
 	e.PutRune('l')
@@ -72,7 +75,7 @@ func TestFourLetters(t *testing.T) {
 }
 
 func TestOneLeft(t *testing.T) {
-	e := newEditor(5)
+	e := NewEditor(5, nil)
 	e.PutRune('h')
 	e.PutRune('l')
 	e.Left()
@@ -83,7 +86,7 @@ func TestOneLeft(t *testing.T) {
 }
 
 func TestOneRem(t *testing.T) {
-	e := newEditor(5)
+	e := NewEditor(5, nil)
 	e.PutRune('h')
 	e.PutRune('l')
 	e.RemRune()
@@ -94,7 +97,7 @@ func TestOneRem(t *testing.T) {
 }
 
 func TestLeftAndRem(t *testing.T) {
-	e := newEditor(5)
+	e := NewEditor(5, nil)
 	e.PutRune('h')
 	e.PutRune('l')
 	e.PutRune('e')
@@ -105,3 +108,20 @@ func TestLeftAndRem(t *testing.T) {
 	e.PutRune('l')
 	assertEditorEq(t, e, hell)
 }
+
+func TestLineFeed(t *testing.T) {
+	e := NewEditor(5, nil)
+	e.PutRune('h')
+	e.PutRune('\n')
+	e.PutRune('l')
+	assertEditorEq(t, e, Editor{
+		text:      [][]rune{{'h', '\n', 'l'}},
+		textWidth: []int{0, 1, 2, 3},
+		cursorIdx: 3,
+		offsetIdx: 0,
+		width:     5,
+	})
+	if content := e.Flush(); content != "h\nl" {
+		t.Errorf("expected content to be %q, got %q\n", "h\nl", content)
+	}
+}
@@ -19,10 +19,11 @@ type UI struct {
 	exit   atomic.Value // bool
 	config Config
 
-	bs     BufferList
-	e      Editor
-	prompt string
-	status string
+	bs          BufferList
+	e           Editor
+	prompt      string
+	status      string
+	statusRight string
 }
 
 func New(config Config) (ui *UI, err error) {
@@ -74,7 +75,7 @@ func (ui *UI) Close() {
 	ui.screen.Fini()
 }
 
-func (ui *UI) CurrentBuffer() string {
+func (ui *UI) CurrentBuffer() (netID, title string) {
 	return ui.bs.Current()
 }
 
@@ -120,30 +121,82 @@ func (ui *UI) ScrollDownBy(n int) {
 	ui.bs.ScrollDown(n)
 }
 
+func (ui *UI) SelectPreviousLine() {
+	ui.bs.SelectPrevious()
+}
+
+func (ui *UI) SelectNextLine() {
+	ui.bs.SelectNext()
+}
+
+func (ui *UI) ClearSelection() {
+	ui.bs.ClearSelection()
+}
+
+func (ui *UI) SelectedLine() (line Line, ok bool) {
+	return ui.bs.Selected()
+}
+
 func (ui *UI) IsAtTop() bool {
 	return ui.bs.IsAtTop()
 }
 
-func (ui *UI) AddBuffer(title string) {
-	_ = ui.bs.Add(title)
+func (ui *UI) AddBuffer(netID, netName, title string) {
+	_ = ui.bs.Add(netID, netName, title)
+}
+
+func (ui *UI) RenameBuffer(netID, title, newTitle string) {
+	_ = ui.bs.Rename(netID, title, newTitle)
+}
+
+func (ui *UI) RemoveBuffer(netID, title string) {
+	_ = ui.bs.Remove(netID, title)
+}
+
+func (ui *UI) RemoveNetworkBuffers(netID string) {
+	ui.bs.RemoveNetwork(netID)
+}
+
+func (ui *UI) SetNetworkName(netID, netName string) {
+	ui.bs.SetNetworkName(netID, netName)
+}
+
+func (ui *UI) AddLine(netID, buffer string, highlight bool, line Line) {
+	ui.bs.AddLine(netID, buffer, highlight, line)
+}
+
+func (ui *UI) AddLines(netID, buffer string, lines []Line) {
+	ui.bs.AddLines(netID, buffer, lines)
+}
+
+func (ui *UI) AddReaction(netID, buffer, msgID, user, reaction string) {
+	ui.bs.AddReaction(netID, buffer, msgID, user, reaction)
 }
 
-func (ui *UI) RemoveBuffer(title string) {
-	_ = ui.bs.Remove(title)
+func (ui *UI) Redact(netID, buffer, msgID, body string) {
+	ui.bs.Redact(netID, buffer, msgID, body)
 }
 
-func (ui *UI) AddLine(buffer string, highlight bool, line Line) {
-	ui.bs.AddLine(buffer, highlight, line)
+func (ui *UI) SetRead(netID, buffer string, t time.Time) {
+	ui.bs.SetRead(netID, buffer, t)
 }
 
-func (ui *UI) AddLines(buffer string, lines []Line) {
-	ui.bs.AddLines(buffer, lines)
+func (ui *UI) MarkCurrentRead() (t time.Time, ok bool) {
+	return ui.bs.MarkCurrentRead()
+}
+
+func (ui *UI) SetContacts(netID string, contacts []Contact) {
+	ui.bs.SetContacts(netID, contacts)
 }
 
 func (ui *UI) SetStatus(status string) {
 	ui.status = status
 }
 
+func (ui *UI) SetStatusRight(status string) {
+	ui.statusRight = status
+}
+
 func (ui *UI) SetPrompt(prompt string) {
 	ui.prompt = prompt
 }
@@ -152,6 +205,10 @@ func (ui *UI) InputIsCommand() bool {
 	return ui.e.IsCommand()
 }
 
+func (ui *UI) InputContent() string {
+	return ui.e.Content()
+}
+
 func (ui *UI) InputLen() int {
 	return ui.e.TextLen()
 }
@@ -231,6 +288,11 @@ func (ui *UI) drawStatusBar(x0, y, width int) {
 		ui.screen.SetContent(x, y, ' ', nil, st)
 	}
 
+	if ui.statusRight != "" {
+		x := x0 + width - 1 - StringWidth(ui.statusRight)
+		printString(ui.screen, &x, y, st, ui.statusRight)
+	}
+
 	if ui.status == "" {
 		return
 	}
@@ -0,0 +1,260 @@
+package senpai
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsProtocol = "text.ircv3.net"
+
+	// wsMaxPayload is the maximum size of a message accepted from the
+	// server, to avoid allocating whatever it announces.
+	wsMaxPayload = 1 << 20
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// websocketConn carries IRC over a WebSocket (RFC 6455), as specified by
+// IRCv3: each message is sent in its own text frame, without CRLF.  It turns
+// frames into CRLF-delimited lines so that it can be used by irc.Session.
+type websocketConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// wl serializes frames written by Write and the answers to the control
+	// frames received by Read.
+	wl sync.Mutex
+
+	// buf is what remains of the last message received, CRLF included.
+	buf []byte
+}
+
+// newWebsocketConn performs the opening handshake of a WebSocket over conn,
+// for the resource at u.
+func newWebsocketConn(conn net.Conn, u *url.URL) (ws *websocketConn, err error) {
+	var nonce [16]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {wsProtocol},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = req.Write(conn)
+	if err != nil {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		return
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", res.Status)
+	}
+	h := sha1.Sum([]byte(key + wsGUID))
+	if res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(h[:]) {
+		return nil, errors.New("WebSocket handshake failed: invalid Sec-WebSocket-Accept")
+	}
+	if p := res.Header.Get("Sec-WebSocket-Protocol"); p != "" && p != wsProtocol {
+		return nil, fmt.Errorf("WebSocket handshake failed: unsupported protocol %q", p)
+	}
+
+	ws = &websocketConn{conn: conn, r: r}
+	return
+}
+
+// Read reads the messages sent by the server, each followed by CRLF.
+func (ws *websocketConn) Read(p []byte) (n int, err error) {
+	for len(ws.buf) == 0 {
+		ws.buf, err = ws.readMessage()
+		if err != nil {
+			return
+		}
+		ws.buf = append(ws.buf, '\r', '\n')
+	}
+
+	n = copy(p, ws.buf)
+	ws.buf = ws.buf[n:]
+	return
+}
+
+// readMessage returns the payload of the next data message, which may span
+// several frames, and answers the control frames received meanwhile.
+func (ws *websocketConn) readMessage() (msg []byte, err error) {
+	for {
+		var fin bool
+		var op byte
+		var payload []byte
+
+		fin, op, payload, err = ws.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case wsOpPing:
+			err = ws.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return
+			}
+		case wsOpPong:
+		case wsOpClose:
+			_ = ws.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			msg = append(msg, payload...)
+			if wsMaxPayload < len(msg) {
+				return nil, errors.New("WebSocket message too large")
+			}
+			if fin {
+				return
+			}
+		default:
+			return nil, fmt.Errorf("unknown WebSocket opcode %d", op)
+		}
+	}
+}
+
+func (ws *websocketConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	_, err = io.ReadFull(ws.r, head[:])
+	if err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(ws.r, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(ws.r, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return
+	}
+	if wsMaxPayload < size {
+		err = errors.New("WebSocket message too large")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		_, err = io.ReadFull(ws.r, mask[:])
+		if err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, size)
+	_, err = io.ReadFull(ws.r, payload)
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Write sends each line of p in its own text frame.
+func (ws *websocketConn) Write(p []byte) (n int, err error) {
+	for _, line := range bytes.Split(p, []byte{'\n'}) {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		err = ws.writeFrame(wsOpText, line)
+		if err != nil {
+			return
+		}
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a single, final, masked frame, as required from clients.
+func (ws *websocketConn) writeFrame(op byte, payload []byte) (err error) {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		frame = append(frame, 0x80|127)
+		frame = append(frame, ext[:]...)
+	}
+
+	var mask [4]byte
+	_, err = rand.Read(mask[:])
+	if err != nil {
+		return
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	ws.wl.Lock()
+	defer ws.wl.Unlock()
+	_, err = ws.conn.Write(frame)
+	return
+}
+
+// Close sends a close frame and closes the connection, without waiting for
+// the server to answer.
+func (ws *websocketConn) Close() error {
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = ws.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000: normal closure
+	return ws.conn.Close()
+}
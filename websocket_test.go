@@ -0,0 +1,109 @@
+package senpai
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// serveWebsocket answers the opening handshake of the client on conn.
+func serveWebsocket(t *testing.T, conn net.Conn) *bufio.Reader {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		t.Errorf("failed to read the handshake: %v", err)
+		return r
+	}
+	if req.URL.Path != "/webirc" || req.Header.Get("Sec-WebSocket-Protocol") != wsProtocol {
+		t.Errorf("unexpected handshake for %q, protocol %q", req.URL.Path, req.Header.Get("Sec-WebSocket-Protocol"))
+	}
+
+	h := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(h[:])+"\r\n"+
+		"Sec-WebSocket-Protocol: "+wsProtocol+"\r\n\r\n")
+	return r
+}
+
+func TestWebsocket(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	frames := make(chan string, 4)
+	go func() {
+		r := serveWebsocket(t, server)
+
+		// A message in two fragments, then a ping in between two messages.
+		go func() {
+			server.Write([]byte{0x01, 5, ':', 's', 'r', 'v', ' '})
+			server.Write([]byte{0x80, 9, 'P', 'I', 'N', 'G', ' ', ':', 'a', 'b', 'c'})
+			server.Write([]byte{0x89, 2, 'h', 'i'})
+			server.Write([]byte{0x81, 4, 'P', 'I', 'N', 'G'})
+		}()
+
+		// Read what the client sends: a pong, then two messages.
+		ws := &websocketConn{conn: server, r: r}
+		for i := 0; i < 3; i++ {
+			fin, op, payload, err := ws.readFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			if !fin {
+				t.Errorf("expected frame %d to be final", i)
+			}
+			frames <- fmt.Sprintf("%x %s", op, payload)
+		}
+		close(frames)
+	}()
+
+	ws, err := newWebsocketConn(client, &url.URL{Host: "irc.example.org", Path: "/webirc"})
+	if err != nil {
+		t.Fatalf("failed to open the WebSocket: %v", err)
+	}
+
+	r := bufio.NewReader(ws)
+	for _, expected := range []string{":srv PING :abc\r\n", "PING\r\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read from the WebSocket: %v", err)
+		}
+		if line != expected {
+			t.Errorf("expected to read %q, got %q", expected, line)
+		}
+	}
+
+	go ws.Write([]byte("PONG :abc\r\nPRIVMSG #senpai :hello\r\n"))
+
+	for _, expected := range []string{"a hi", "1 PONG :abc", "1 PRIVMSG #senpai :hello"} {
+		if frame := <-frames; frame != expected {
+			t.Errorf("expected the client to send frame %q, got %q", expected, frame)
+		}
+	}
+}
+
+func TestWebsocketTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		handshakeTimeout = timeout
+	}(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	// The server reads the handshake, but never answers.
+	client, server := net.Pipe()
+	defer server.Close()
+	go http.ReadRequest(bufio.NewReader(server))
+
+	_, err := newWebsocketConn(client, &url.URL{Host: "irc.example.org", Path: "/webirc"})
+	if err == nil {
+		t.Errorf("expected the handshake to time out")
+	}
+}
@@ -1,10 +1,12 @@
 package senpai
 
 import (
+	"fmt"
 	"math/rand"
 	"strings"
 	"time"
 
+	"git.sr.ht/~taiite/senpai/irc"
 	"git.sr.ht/~taiite/senpai/ui"
 )
 
@@ -21,30 +23,46 @@ var homeMessages = []string{
 
 func (app *App) initWindow() {
 	hmIdx := rand.Intn(len(homeMessages))
-	app.win.AddBuffer(Home)
-	app.addLineNow("", ui.Line{
+	app.win.AddBuffer("", "", Home)
+	app.addLineNow("", Home, ui.Line{
 		Head: "--",
 		Body: homeMessages[hmIdx],
 	})
 }
 
-func (app *App) addLineNow(buffer string, line ui.Line) {
+func (app *App) addLineNow(netID, buffer string, line ui.Line) {
 	if line.At.IsZero() {
 		line.At = time.Now()
 	}
-	app.win.AddLine(buffer, false, line)
+	app.win.AddLine(netID, buffer, false, line)
 	app.draw()
 }
 
 func (app *App) draw() {
-	if app.s != nil {
-		app.setStatus()
+	netID, _ := app.win.CurrentBuffer()
+	if n := app.networks[netID]; n != nil && n.s != nil {
+		app.markRead(n.s)
+		app.setStatus(n)
 	}
 	app.win.Draw()
 }
 
-func (app *App) setStatus() {
-	ts := app.s.Typings(app.win.CurrentBuffer())
+// markRead moves the read marker of the current buffer to its last message,
+// unless it is scrolled up, and tells the server about it.
+func (app *App) markRead(s *irc.Session) {
+	_, buffer := app.win.CurrentBuffer()
+	if buffer == Home {
+		return
+	}
+	if t, ok := app.win.MarkCurrentRead(); ok {
+		s.SetReadMarker(buffer, t)
+	}
+}
+
+// setStatus shows the state of the current buffer, whose network is n.
+func (app *App) setStatus(n *network) {
+	_, buffer := app.win.CurrentBuffer()
+	ts := n.s.Typings(buffer)
 	status := ""
 	if 3 < len(ts) {
 		status = "several people are typing..."
@@ -58,5 +76,45 @@ func (app *App) setStatus() {
 			status += ts[len(ts)-1] + verb
 		}
 	}
+	if selected, ok := app.win.SelectedLine(); ok {
+		status = "replying to " + selected.Head + " (Escape to cancel)"
+	}
 	app.win.SetStatus(status)
+
+	var right []string
+	if counter := app.inputCounter(n.s); counter != "" {
+		right = append(right, counter)
+	}
+	if queued := n.s.Queued(); queued == 1 {
+		right = append(right, "1 line queued")
+	} else if 1 < queued {
+		right = append(right, fmt.Sprintf("%d lines queued", queued))
+	}
+	if n.lag != 0 {
+		right = append(right, fmt.Sprintf("lag %.1fs", n.lag.Seconds()))
+	}
+	app.win.SetStatusRight(strings.Join(right, ", "))
+}
+
+// inputCounter returns, when the content of the input field is too long to be
+// sent in one message, its length and the number of messages it would be split
+// into.
+func (app *App) inputCounter(s *irc.Session) string {
+	_, buffer := app.win.CurrentBuffer()
+	if buffer == Home || app.win.InputIsCommand() {
+		return ""
+	}
+
+	maxLen := s.MaxContentLen(buffer)
+	lines := strings.Split(app.win.InputContent(), "\n")
+	size, parts := 0, 0
+	for _, line := range lines {
+		size += len(line)
+		parts += len(irc.SplitMessage(line, maxLen))
+	}
+	if parts == len(lines) {
+		return ""
+	}
+
+	return fmt.Sprintf("%d/%d bytes, %d messages", size, maxLen, parts)
 }